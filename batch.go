@@ -0,0 +1,271 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-pg/pg"
+)
+
+// ErrBatchAborted is the result of statements which were not applied because their batch failed.
+var ErrBatchAborted = errors.New("batch failed, statement not applied")
+
+// Batch collects statements which are sent to a node in a single round trip, see Cluster.SendBatch.
+// The zero value is an empty batch.
+type Batch struct {
+	statements []batchStatement
+}
+
+type batchStatement struct {
+	query string
+	args  []interface{}
+	// write forces the batch to master regardless of query
+	write bool
+}
+
+// Queue adds a statement to the batch. Rows returned by statements are discarded.
+//
+// The batch goes to a slave when every statement looks like a read, which is decided by the statement text only:
+// a select calling a function which writes or is volatile, such as nextval or a function updating a table,
+// looks like a read and fails or misbehaves on a slave. Queue such statements with QueueWrite.
+func (b *Batch) Queue(query string, args ...interface{}) {
+	b.statements = append(b.statements, batchStatement{query: query, args: args})
+}
+
+// QueueWrite adds a statement which must run on master even though it looks like a read,
+// for example a select calling a function which writes.
+func (b *Batch) QueueWrite(query string, args ...interface{}) {
+	b.statements = append(b.statements, batchStatement{query: query, args: args, write: true})
+}
+
+// Len returns the number of queued statements.
+func (b *Batch) Len() int {
+	return len(b.statements)
+}
+
+// writes tells whether any statement of the batch has to run on master.
+func (b *Batch) writes() bool {
+	for _, statement := range b.statements {
+		if statement.write || isWriteStatement(statement.query) {
+			return true
+		}
+	}
+	return false
+}
+
+// BatchResult is the result of a statement of a batch.
+type BatchResult struct {
+	// RowsAffected is the number of rows the statement inserted, updated, deleted or returned.
+	RowsAffected int
+	// Err is nil when the statement was applied, the error of the statement which failed the batch,
+	// or ErrBatchAborted for the other statements.
+	Err error
+}
+
+// SendBatch sends all statements of b to one node in a single round trip and returns a result per statement.
+// The batch runs on master when any statement writes, otherwise on a reader picked like QueryContext,
+// see Batch.Queue for statements which must be queued with QueueWrite.
+//
+// Statements are sent as one multi-statement query, which postgres runs in a single implicit transaction:
+// the batch is applied entirely or not at all and must not contain transaction control statements.
+// Selects, inserts, updates and deletes are wrapped to count their rows on the server, so they must be
+// single statements which can be used as a subquery or in a WITH clause. Other statements, such as DDL
+// or a WITH query which writes, run as they are and report the number of rows they return.
+func (c *Cluster) SendBatch(ctx context.Context, b *Batch) ([]BatchResult, error) {
+	if b.Len() == 0 {
+		return nil, nil
+	}
+	if err := c.acquire(); err != nil {
+		return nil, err
+	}
+	defer c.release()
+
+	pick := c.writer
+	if !b.writes() {
+		pick = func() (*connection, error) {
+			return c.reader(ctx)
+		}
+	}
+	var results []BatchResult
+	err := onConnection(pick, func(conn *connection) error {
+		var err error
+		results, err = conn.batch(ctx, b.statements)
+		return err
+	})
+	return results, err
+}
+
+// readKeywords start statements which never write, given they do not lock rows.
+var readKeywords = map[string]bool{
+	"select": true,
+	"show":   true,
+	"values": true,
+	"table":  true,
+}
+
+var (
+	lockingClause  = regexp.MustCompile(`(?i)\bfor\s+(update|share|no\s+key\s+update|key\s+share)\b|\binto\b`)
+	writeKeyword   = regexp.MustCompile(`(?i)\b(insert|update|delete|merge)\b`)
+	analyzeKeyword = regexp.MustCompile(`(?i)\banaly[sz]e\b`)
+	leadingNoise   = regexp.MustCompile(`^(\s+|--[^\n]*|/\*(?s:.*?)\*/|\()+`)
+)
+
+// isWriteStatement classifies query by its first keyword, anything not known to be a read is a write.
+// Keywords are also matched in string literals, which may send a read to master but never a write to a slave.
+func isWriteStatement(query string) bool {
+	query = leadingNoise.ReplaceAllString(query, "")
+	switch keyword := firstKeyword(query); {
+	case readKeywords[keyword]:
+		return lockingClause.MatchString(query)
+	case keyword == "with":
+		return lockingClause.MatchString(query) || writeKeyword.MatchString(query)
+	case keyword == "explain":
+		// explain analyze runs the statement
+		return analyzeKeyword.MatchString(query) && (lockingClause.MatchString(query) || writeKeyword.MatchString(query))
+	}
+	return true
+}
+
+// firstKeyword returns the lower cased keyword query starts with, leading noise has to be removed already.
+func firstKeyword(query string) string {
+	end := strings.IndexFunc(query, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+	})
+	if end < 0 {
+		end = len(query)
+	}
+	return strings.ToLower(query[:end])
+}
+
+const (
+	// batchBeginColumn names the row which separates settings from statements of a batch query
+	batchBeginColumn = "hansip_batch_begin"
+	// batchRowsColumn names the row every statement of a batch query ends with
+	batchRowsColumn = "hansip_batch_rows"
+)
+
+var (
+	intoClause      = regexp.MustCompile(`(?i)\binto\b`)
+	returningClause = regexp.MustCompile(`(?i)\breturning\b`)
+	dollarTag       = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+)
+
+// countingStatement rewrites formatted query so that it ends with a single row in column batchRowsColumn.
+// Selects and data modifying statements are wrapped to count their rows on the server,
+// the row of other statements is null and the rows they return are counted instead.
+func countingStatement(query string) string {
+	code := blankLiterals(query)
+	end := len(strings.TrimRight(code, "; \t\r\n"))
+	query, code = query[:end], code[:end]
+
+	keyword := firstKeyword(leadingNoise.ReplaceAllString(code, ""))
+	switch {
+	case intoClause.MatchString(code) && keyword != "insert":
+		// select into creates a table and can not be a subquery
+	case readKeywords[keyword] && keyword != "show", keyword == "with" && !writeKeyword.MatchString(code):
+		return "select count(*) as " + batchRowsColumn + " from (\n" + query + "\n) as hansip_statement"
+	case keyword == "insert", keyword == "update", keyword == "delete":
+		if !returningClause.MatchString(code) {
+			query += "\nreturning 1"
+		}
+		return "with hansip_statement as (\n" + query + "\n) select count(*) as " + batchRowsColumn + " from hansip_statement"
+	}
+	return query + "\n;\nselect null::bigint as " + batchRowsColumn
+}
+
+// blankLiterals replaces string literals and quoted identifiers of query with underscores and comments with spaces,
+// so keywords and semicolons left in it belong to the statement. Offsets of query are kept.
+func blankLiterals(query string) string {
+	code := []byte(query)
+	for i := 0; i < len(query); {
+		var end int
+		switch rest := query[i:]; {
+		case rest[0] == '\'' || rest[0] == '"':
+			escapes := rest[0] == '\'' && i > 0 && (query[i-1] == 'e' || query[i-1] == 'E')
+			end = closingQuote(query, i, escapes)
+		case strings.HasPrefix(rest, "--"):
+			end = skipPast(query, i, "\n")
+		case strings.HasPrefix(rest, "/*"):
+			end = skipPast(query, i+2, "*/")
+		case rest[0] == '$' && (i == 0 || !isIdentifierByte(query[i-1])) && dollarTag.MatchString(rest):
+			tag := dollarTag.FindString(rest)
+			end = skipPast(query, i+len(tag), tag)
+		default:
+			i++
+			continue
+		}
+		blank := byte('_')
+		if query[i] == '-' || query[i] == '/' {
+			blank = ' '
+		}
+		for ; i < end; i++ {
+			code[i] = blank
+		}
+	}
+	return string(code)
+}
+
+// closingQuote returns the offset after the quote closing the one at start, doubled quotes are part of the literal.
+func closingQuote(query string, start int, escapes bool) int {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		switch {
+		case escapes && query[i] == '\\':
+			i++
+		case query[i] == quote && i+1 < len(query) && query[i+1] == quote:
+			i++
+		case query[i] == quote:
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+// skipPast returns the offset after the first terminator found from offset from, or the length of query.
+func skipPast(query string, from int, terminator string) int {
+	if i := strings.Index(query[from:], terminator); i >= 0 {
+		return from + i + len(terminator)
+	}
+	return len(query)
+}
+
+func isIdentifierByte(b byte) bool {
+	return b == '_' || b == '$' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+}
+
+// batchResults creates results of a batch in which statement failed failed with err,
+// failed is -1 when the failing statement is not known.
+func batchResults(n int, failed int, err error) []BatchResult {
+	results := make([]BatchResult, n)
+	if err == nil {
+		return results
+	}
+	for i := range results {
+		results[i].Err = ErrBatchAborted
+		if i == failed {
+			results[i].Err = err
+		}
+	}
+	return results
+}
+
+// failedStatement finds the statement containing position of err, which postgres reports for errors
+// found before the batch runs, such as syntax errors. starts are offsets of statements in characters
+// as postgres counts the position from 1.
+func failedStatement(starts []int, err error) int {
+	var pgErr pg.Error
+	if !errors.As(err, &pgErr) {
+		return -1
+	}
+	position, convErr := strconv.Atoi(pgErr.Field('P'))
+	if convErr != nil || position < 1 {
+		return -1
+	}
+	return sort.Search(len(starts), func(i int) bool {
+		return starts[i] > position-1
+	}) - 1
+}
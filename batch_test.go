@@ -0,0 +1,195 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-pg/pg"
+	"github.com/stretchr/testify/suite"
+)
+
+type BatchTestSuite struct {
+	TestSuite
+}
+
+func TestBatch(t *testing.T) {
+	s := &BatchTestSuite{}
+	s.noCreateCluster = true
+	suite.Run(t, s)
+}
+
+func (s *BatchTestSuite) TestIsWriteStatement() {
+	reads := []string{
+		"select 1;",
+		"  SELECT * from users where name = 'update';",
+		"/* caller */\n-- note\n(select 1) union (select 2);",
+		"show search_path;",
+		"values (1), (2);",
+		"table users;",
+		"with recent as (select * from users) select * from recent;",
+		"explain select * from users;",
+		"explain delete from users;",
+	}
+	for _, query := range reads {
+		s.False(isWriteStatement(query), query)
+	}
+
+	writes := []string{
+		"insert into users values (1);",
+		"update users set name = 'a';",
+		"delete from users;",
+		"create table users (id int);",
+		"select * from users for update;",
+		"select * from users for no key update;",
+		"select * into archive from users;",
+		"with moved as (delete from users returning *) insert into archive select * from moved;",
+		"explain analyze delete from users;",
+		"vacuum users;",
+		"",
+	}
+	for _, query := range writes {
+		s.True(isWriteStatement(query), query)
+	}
+}
+
+func (s *BatchTestSuite) TestCountingStatement() {
+	s.Equal("select count(*) as hansip_batch_rows from (\nselect * from users where name = 'a;b'\n) as hansip_statement",
+		countingStatement("select * from users where name = 'a;b';"))
+	s.Equal("with hansip_statement as (\ninsert into users values (1, 'returning')\nreturning 1\n) select count(*) as hansip_batch_rows from hansip_statement",
+		countingStatement("insert into users values (1, 'returning') -- note;\n;"))
+	s.Equal("with hansip_statement as (\ndelete from users returning id\n) select count(*) as hansip_batch_rows from hansip_statement",
+		countingStatement("delete from users returning id"))
+	s.Equal("update users set name = $$it's; $$\nreturning 1",
+		strings.SplitN(strings.SplitN(countingStatement("update users set name = $$it's; $$ /* ; */;"), "(\n", 2)[1], "\n)", 2)[0])
+
+	unwrapped := []string{
+		"create table users (id int)",
+		"show search_path",
+		"select * into archive from users",
+		"with moved as (delete from users returning *) insert into archive select * from moved",
+	}
+	for _, query := range unwrapped {
+		s.Equal(query+"\n;\nselect null::bigint as hansip_batch_rows", countingStatement(query+";"), query)
+	}
+}
+
+func (s *BatchTestSuite) TestBlankLiterals() {
+	s.Equal("select ______, ____, E______, _______,               1",
+		blankLiterals("select 'a''b', \"a;\", E'\\'; ', $t$;$t$, /* ; */ -- ;\n 1"))
+}
+
+func (s *BatchTestSuite) TestRouting() {
+	slave := &dummySQL{}
+	cluster, master := newDummyCluster(&Config{}, &connection{connected: 1, s: slave})
+
+	results, err := cluster.SendBatch(context.Background(), &Batch{})
+	s.Nil(err)
+	s.Nil(results)
+	s.False(slave.batchRun || master.batchRun)
+
+	var reads Batch
+	reads.Queue("select 1;")
+	reads.Queue("select ?;", 2)
+	results, err = cluster.SendBatch(context.Background(), &reads)
+	s.Nil(err)
+	s.Equal([]BatchResult{{}, {}}, results)
+	s.True(slave.batchRun)
+	s.False(master.batchRun)
+
+	slave.batchRun = false
+	var writes Batch
+	writes.Queue("select 1;")
+	writes.Queue("insert into users values (?);", 1)
+	_, err = cluster.SendBatch(context.Background(), &writes)
+	s.Nil(err)
+	s.True(master.batchRun)
+	s.False(slave.batchRun)
+
+	master.batchRun = false
+	var forced Batch
+	forced.QueueWrite("select nextval('users_id_seq');")
+	_, err = cluster.SendBatch(context.Background(), &forced)
+	s.Nil(err)
+	s.True(master.batchRun)
+	s.False(slave.batchRun)
+
+	cluster.manager.master = nil
+	_, err = cluster.SendBatch(context.Background(), &writes)
+	s.Equal(ErrNoMasterAvailable, err)
+}
+
+func (s *BatchTestSuite) TestFailedStatement() {
+	starts := []int{10, 25, 40}
+	s.Equal(-1, failedStatement(starts, errors.New("connection reset")))
+	s.Equal(-1, failedStatement(starts, &fakePGError{code: "22012", message: "division by zero"}))
+	s.Equal(0, failedStatement(starts, &fakePGError{code: "42601", position: "11"}))
+	s.Equal(0, failedStatement(starts, &fakePGError{code: "42601", position: "25"}))
+	s.Equal(1, failedStatement(starts, &fakePGError{code: "42601", position: "26"}))
+	s.Equal(2, failedStatement(starts, &fakePGError{code: "42601", position: "60"}))
+	s.Equal(-1, failedStatement(starts, &fakePGError{code: "42601", position: "3"}))
+}
+
+func (s *BatchTestSuite) TestWrapsErrors() {
+	pgErr := &fakePGError{code: "42601", message: "syntax error at or near \"selec\""}
+	conn := &connection{host: "db1:5432", role: RoleMaster, s: &failingSQL{err: pgErr}}
+
+	results, err := conn.batch(context.Background(), []batchStatement{{query: "selec 1;"}, {query: "select 2;"}})
+	var hansipErr *Error
+	s.True(errors.As(err, &hansipErr))
+	s.Equal("batch", hansipErr.Op)
+	s.Equal("42601", hansipErr.SQLState)
+	s.Len(results, 2)
+	s.Equal(err, results[0].Err)
+	s.Equal(ErrBatchAborted, results[1].Err)
+}
+
+func (s *BatchTestSuite) TestSendBatch() {
+	cluster := NewCluster(&Config{})
+	defer cluster.Shutdown(context.Background())
+	s.Nil(cluster.SetMaster(s.getMasterConnectionInfo()))
+
+	s.Nil(cluster.WriterExec("drop table if exists hansip_batch;"))
+	s.Nil(cluster.WriterExec("create table hansip_batch (id int primary key, name text);"))
+	defer cluster.WriterExec("drop table hansip_batch;")
+
+	var batch Batch
+	batch.Queue("insert into hansip_batch values (?, ?);", 1, "it's; -- tricky")
+	batch.Queue("insert into hansip_batch values (?, ?) -- trailing comment", 2, "b")
+	batch.Queue("update hansip_batch set name = ? where id = ?;", "c", 2)
+	batch.Queue("select * from hansip_batch;")
+	results, err := cluster.SendBatch(context.Background(), &batch)
+	s.Nil(err)
+	s.Equal([]BatchResult{{RowsAffected: 1}, {RowsAffected: 1}, {RowsAffected: 1}, {RowsAffected: 2}}, results)
+
+	var names []string
+	s.Nil(cluster.WriterQuery(&names, "select name from hansip_batch order by id;"))
+	s.Equal([]string{"it's; -- tricky", "c"}, names)
+
+	// the failing statement gets the error, nothing of the batch is applied
+	var failing Batch
+	failing.Queue("insert into hansip_batch values (?, ?);", 3, "d")
+	failing.Queue("insert into hansip_batch_missing values (?);", 4)
+	failing.Queue("insert into hansip_batch values (?, ?);", 5, "e")
+	results, err = cluster.SendBatch(context.Background(), &failing)
+	s.Equal("42P01", SQLState(err))
+	s.Len(results, 3)
+	s.Equal(ErrBatchAborted, results[0].Err)
+	s.Equal(err, results[1].Err)
+	s.Equal(ErrBatchAborted, results[2].Err)
+
+	// a syntax error fails the batch before it runs, the statement is found by the position of the error
+	var invalid Batch
+	invalid.Queue("insert into hansip_batch values (?, ?);", 6, "f")
+	invalid.Queue("selec 7;")
+	results, err = cluster.SendBatch(context.Background(), &invalid)
+	s.Equal("42601", SQLState(err))
+	s.Len(results, 2)
+	s.Equal(ErrBatchAborted, results[0].Err)
+	s.Equal(err, results[1].Err)
+
+	var count int
+	s.Nil(cluster.WriterQuery(pg.Scan(&count), "select count(*) from hansip_batch;"))
+	s.Equal(2, count)
+}
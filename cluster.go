@@ -1,23 +1,30 @@
 package hansip
 
 import (
+	"context"
 	"errors"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/go-pg/pg"
 )
 
 const (
-	defaultMaxAttempt      = 3
-	defaultConnRetryDelay  = 3 * time.Second
-	defaultConnCheckDelay  = 3 * time.Second
-	defaultConnPingTimeout = 1 * time.Second
+	defaultMaxAttempt       = 3
+	defaultConnRetryDelay   = 3 * time.Second
+	defaultConnCheckDelay   = 3 * time.Second
+	defaultConnPingTimeout  = 1 * time.Second
+	defaultFailureThreshold = 1
+	defaultSuccessThreshold = 1
+	defaultWeight           = 1
 )
 
 // errors definition
 var (
 	ErrNoSlaveAvailable  = errors.New("no slave connection available")
 	ErrNoMasterAvailable = errors.New("no master connection available")
+	ErrClusterClosed     = errors.New("cluster is closed")
 )
 
 // Config contains pg.Options for remote postgres
@@ -27,27 +34,104 @@ type Config struct {
 	ConnRetryDelay         time.Duration
 	ConnCheckDelay         time.Duration
 	ConnPingTimeout        time.Duration
+
+	// FailureThreshold is the number of consecutive failed pings needed to mark a node down.
+	FailureThreshold int
+	// SuccessThreshold is the number of consecutive successful pings needed to mark a node up.
+	SuccessThreshold int
+	// HealthCheck decides whether a node is healthy, it runs every ConnCheckDelay.
+	// Defaults to running "select 1;". See HealthCheckQuery and HealthCheckCondition.
+	HealthCheck HealthCheck
+	// Pool contains cluster wide pool settings merged into pg.Options of every node,
+	// settings missing from pg.Options are taken from here. Use Pool node option to override them per node.
+	// Changes by Reload apply to nodes connected afterwards.
+	Pool PoolConfig
+	// CredentialProvider supplies credentials of nodes whose passwords rotate or expire, such as IAM auth tokens.
+	// It is asked before every statement or transaction on a node and on every health check, a node whose
+	// credentials change gets a new pool and its previous pool is closed once work running on it is done.
+	// Wrap it with NewCredentialCache to avoid fetching credentials every time.
+	CredentialProvider CredentialProvider
+	// TLS encrypts connections to every node and verifies their certificates.
+	// When nil, TLSConfig of pg.Options is used as it is.
+	TLS *TLSConfig
+	// LocalZone is the availability zone of this process. Reads prefer slaves with the same Zone node option
+	// and spill over to other zones only when local slaves are down or saturated, see CrossZoneReads.
+	LocalZone string
+	// SaturationThreshold is the number of running reads which saturates a slave. Zero means slaves never saturate.
+	SaturationThreshold int
+	// DefaultStatementTimeout bounds runtime of queries which have no timeout of their own, see WithStatementTimeout.
+	// Queries are cancelled on the server once it passes, transactions apply it with SET LOCAL statement_timeout.
+	// Timeouts are returned as StatementTimeoutError. Zero means no timeout.
+	DefaultStatementTimeout time.Duration
+	// ReservedTags lists tags of slaves which only serve queries targeting them, such as "analytics" or "delayed".
+	// Other queries never run on slaves having any of these tags.
+	ReservedTags []string
+	// LazyConnect registers nodes that are down when added instead of returning an error.
+	// They are kept in disconnected state and start receiving queries once they answer pings.
+	LazyConnect bool
+	// MaxCheckBackoff enables exponential backoff with jitter on ping interval of nodes that are down.
+	// The interval starts at ConnCheckDelay and grows up to MaxCheckBackoff. Zero disables backoff.
+	MaxCheckBackoff time.Duration
 }
 
 // Cluster abstracts database connections to remote postgres.
 type Cluster struct {
 	manager *connectionManager
 	conf    *Config
+
+	// tracks running queries and open transactions so Shutdown can wait for them,
+	// also guards conf which can be replaced by Reload
+	mutex     sync.Mutex
+	closed    bool
+	inflight  int
+	drained   chan struct{}
+	closeOnce sync.Once
+	// set once connections are killed, transactions still open then fail with ErrClusterClosed
+	killed bool
+	// closed when Shutdown starts, stops background loops of the cluster
+	quitChan chan struct{}
+
+	// nodes from ClusterConfig, they are reconciled by Reload
+	reloadMutex  sync.Mutex
+	configMaster string
+	// options master from ClusterConfig was created with
+	configMasterOpts *nodeOptions
+	configSlaves     *slaveSet
 }
 
-// SetMaster creates a connection to given connection info and set it as master
-func (c *Cluster) SetMaster(opts *pg.Options) error {
-	conn, err := newConnection(opts, c.conf.ConnPingTimeout, c.conf.ConnCheckDelay)
+// SetMaster creates a connection to given connection info and set it as master.
+// When Config.LazyConnect is set, the master is registered even if it is down.
+func (c *Cluster) SetMaster(opts *pg.Options, nodeOpts ...NodeOption) error {
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	defer c.release()
+
+	conn, err := newConnection(opts, c.getConfig(), newNodeOptions(nodeOpts))
 	if err != nil {
 		return err
 	}
-	c.manager.master = conn
+	conn.role = RoleMaster
+	// transactions and statements running on the previous master, such as during a failover, are allowed to finish
+	if previous := c.manager.setMaster(conn); previous != nil {
+		c.manager.retire(previous)
+	}
 	return nil
 }
 
-// AddSlave creates a connection to given connection info and add it as slave
-func (c *Cluster) AddSlave(opts *pg.Options) error {
-	conn, err := newConnection(opts, c.conf.ConnPingTimeout, c.conf.ConnCheckDelay)
+// AddSlave creates a connection to given connection info and add it as slave.
+// When Config.LazyConnect is set, the slave is registered even if it is down.
+func (c *Cluster) AddSlave(opts *pg.Options, nodeOpts ...NodeOption) error {
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	defer c.release()
+
+	return c.addSlave(opts, c.getConfig(), nodeOpts)
+}
+
+func (c *Cluster) addSlave(opts *pg.Options, conf *Config, nodeOpts []NodeOption) error {
+	conn, err := newConnection(opts, conf, newNodeOptions(nodeOpts))
 	if err != nil {
 		return err
 	}
@@ -56,45 +140,224 @@ func (c *Cluster) AddSlave(opts *pg.Options) error {
 	return nil
 }
 
-// Query runs query to one of randomly-picked slave connection.
+// Query runs query to one of randomly-picked slave connection, slaves with higher weight are picked more often.
 // If there is no slave available, the query will be run on writer.
+// Slaves with Config.ReservedTags are skipped, use QueryOn or QueryContext to target them.
 func (c *Cluster) Query(dest interface{}, query string, args ...interface{}) error {
-	conn := c.manager.reader()
-	if conn == nil {
-		return ErrNoSlaveAvailable
-	}
-	return conn.query(dest, query, args...)
+	return c.QueryContext(context.Background(), dest, query, args...)
 }
 
 // WriterExec runs a query to master connection.
 func (c *Cluster) WriterExec(query string, args ...interface{}) error {
-	conn := c.manager.writer()
-	if conn == nil {
-		return ErrNoMasterAvailable
+	return c.WriterExecContext(context.Background(), query, args...)
+}
+
+// WriterExecContext runs a query to master connection, it is cancelled when ctx is done.
+func (c *Cluster) WriterExecContext(ctx context.Context, query string, args ...interface{}) error {
+	if err := c.acquire(); err != nil {
+		return err
 	}
-	return conn.exec(query, args...)
+	defer c.release()
+
+	return onConnection(c.writer, func(conn *connection) error {
+		return conn.exec(ctx, query, args...)
+	})
 }
 
 // WriterQuery runs query to master connection.
 func (c *Cluster) WriterQuery(dest interface{}, query string, args ...interface{}) error {
-	conn := c.manager.writer()
-	if conn == nil {
-		return ErrNoMasterAvailable
+	return c.WriterQueryContext(context.Background(), dest, query, args...)
+}
+
+// WriterQueryContext runs query to master connection, it is cancelled when ctx is done.
+func (c *Cluster) WriterQueryContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	if err := c.acquire(); err != nil {
+		return err
 	}
-	return conn.query(dest, query, args...)
+	defer c.release()
+
+	return onConnection(c.writer, func(conn *connection) error {
+		return conn.query(ctx, dest, query, args...)
+	})
 }
 
 // NewTransaction creates a new database transaction.
 // This method guaratees that the transaction will be run on master connection.
+// Shutdown waits for the transaction to be committed or rolled back.
+// The transaction implements CopyTransaction.
 func (c *Cluster) NewTransaction() (Transaction, error) {
-	conn := c.manager.writer()
+	return c.NewTransactionContext(context.Background())
+}
+
+// NewTransactionContext creates a new database transaction like NewTransaction,
+// settings carried by ctx such as WithTenant apply to the whole transaction.
+func (c *Cluster) NewTransactionContext(ctx context.Context) (Transaction, error) {
+	if err := c.acquire(); err != nil {
+		return nil, err
+	}
+
+	var tx CopyTransaction
+	err := onConnection(c.writer, func(conn *connection) error {
+		var err error
+		tx, err = conn.newTransaction(ctx)
+		return err
+	})
+	if err != nil {
+		c.release()
+		return nil, err
+	}
+	return &trackedTransaction{
+		CopyTransaction: tx,
+		cluster:         c,
+	}, nil
+}
+
+// Shutdown stops accepting new work, waits for running queries and open transactions
+// to finish or ctx to be done, then kills all connections.
+// It is safe to call Shutdown multiple times, every call waits for the same shutdown.
+// ctx.Err() is returned when ctx is done before all work is finished.
+func (c *Cluster) Shutdown(ctx context.Context) error {
+	c.mutex.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.quitChan)
+		if c.inflight == 0 {
+			close(c.drained)
+		}
+	}
+	c.mutex.Unlock()
+
+	var err error
+	select {
+	case <-c.drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	c.closeOnce.Do(func() {
+		c.mutex.Lock()
+		c.killed = true
+		c.mutex.Unlock()
+		c.manager.quit()
+	})
+	return err
+}
+
+func (c *Cluster) isKilled() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.killed
+}
+
+// CrossZoneReads returns the number of reads served by slaves outside of Config.LocalZone.
+func (c *Cluster) CrossZoneReads() uint64 {
+	return c.manager.getCrossZoneReads()
+}
+
+func (c *Cluster) getConfig() *Config {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conf
+}
+
+func (c *Cluster) setConfig(conf *Config) {
+	c.mutex.Lock()
+	c.conf = conf
+	c.mutex.Unlock()
+}
+
+func (c *Cluster) acquire() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return ErrClusterClosed
+	}
+	c.inflight++
+	return nil
+}
+
+func (c *Cluster) release() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.inflight--
+	if c.closed && c.inflight == 0 {
+		close(c.drained)
+	}
+}
+
+// writer returns master or ErrNoMasterAvailable.
+func (c *Cluster) writer() (*connection, error) {
+	conn := c.manager.writerConnection()
 	if conn == nil {
 		return nil, ErrNoMasterAvailable
 	}
-	return c.manager.writer().newTransaction()
+	return conn, nil
+}
+
+// onConnection runs fn on a connection returned by pick. A connection retired after it was picked,
+// for example by SetMaster, is not in the manager anymore, so fn is run again on a newly picked one.
+func onConnection(pick func() (*connection, error), fn func(conn *connection) error) error {
+	for {
+		conn, err := pick()
+		if err != nil {
+			return err
+		}
+		if err := fn(conn); err != errRetired {
+			return err
+		}
+	}
 }
 
-// Shutdown kills all connections.
-func (c *Cluster) Shutdown() {
-	c.manager.quit()
+// trackedTransaction releases its slot in the cluster once it is finished.
+// Once Shutdown gives up waiting and kills connections, it fails with ErrClusterClosed.
+type trackedTransaction struct {
+	CopyTransaction
+	cluster     *Cluster
+	releaseOnce sync.Once
+}
+
+func (tx *trackedTransaction) Query(dest interface{}, query string, args ...interface{}) error {
+	if tx.cluster.isKilled() {
+		return ErrClusterClosed
+	}
+	return tx.CopyTransaction.Query(dest, query, args...)
+}
+
+func (tx *trackedTransaction) Exec(query string, args ...interface{}) error {
+	if tx.cluster.isKilled() {
+		return ErrClusterClosed
+	}
+	return tx.CopyTransaction.Exec(query, args...)
+}
+
+func (tx *trackedTransaction) CopyFrom(r io.Reader, query string, args ...interface{}) (int, error) {
+	if tx.cluster.isKilled() {
+		return 0, ErrClusterClosed
+	}
+	return tx.CopyTransaction.CopyFrom(r, query, args...)
+}
+
+func (tx *trackedTransaction) CopyTo(w io.Writer, query string, args ...interface{}) (int, error) {
+	if tx.cluster.isKilled() {
+		return 0, ErrClusterClosed
+	}
+	return tx.CopyTransaction.CopyTo(w, query, args...)
+}
+
+func (tx *trackedTransaction) Commit() error {
+	return tx.finish(tx.CopyTransaction.Commit)
+}
+
+func (tx *trackedTransaction) Rollback() error {
+	return tx.finish(tx.CopyTransaction.Rollback)
+}
+
+func (tx *trackedTransaction) finish(fn func() error) error {
+	defer tx.releaseOnce.Do(tx.cluster.release)
+	if tx.cluster.isKilled() {
+		return ErrClusterClosed
+	}
+	return fn()
 }
@@ -1,8 +1,13 @@
 package hansip
 
 import (
+	"context"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/go-pg/pg"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -27,9 +32,9 @@ func (s *ClusterTestSuite) TestCreatesMasterAndSlaveConnection() {
 }
 
 func (s *ClusterTestSuite) TestKillConnectionsAfterShutdown() {
-	s.cluster.Shutdown()
+	s.Nil(s.cluster.Shutdown(context.Background()))
 	s.Nil(s.cluster.manager.writer())
-	s.Nil(s.cluster.manager.reader())
+	s.Nil(s.cluster.manager.pickReader(nil))
 }
 
 func (s *ClusterTestSuite) TestUseMasterWhenNoSlaveAvailable() {
@@ -40,3 +45,173 @@ func (s *ClusterTestSuite) TestUseMasterWhenNoSlaveAvailable() {
 	s.Nil(s.cluster.Query(&temp, "select 2;"))
 	s.Equal(temp, 2)
 }
+
+type ClusterShutdownTestSuite struct {
+	TestSuite
+}
+
+func TestClusterShutdown(t *testing.T) {
+	s := &ClusterShutdownTestSuite{}
+	s.noCreateCluster = true
+	suite.Run(t, s)
+}
+
+func (s *ClusterShutdownTestSuite) newCluster(master sql) *Cluster {
+	cluster := NewCluster(&Config{})
+	cluster.manager.master = &connection{
+		connected:      1,
+		connCheckDelay: 1 * time.Hour,
+		s:              master,
+		quitChan:       make(chan struct{}),
+	}
+	go cluster.manager.master.loop()
+	return cluster
+}
+
+func (s *ClusterShutdownTestSuite) TestWaitsForRunningQueries() {
+	master := &dummySQL{block: make(chan struct{})}
+	cluster := s.newCluster(master)
+
+	queryDone := make(chan error)
+	go func() {
+		var temp int
+		queryDone <- cluster.Query(&temp, "select 1;")
+	}()
+	time.Sleep(100 * time.Millisecond) // wait query to start
+
+	shutdownDone := make(chan error)
+	go func() {
+		shutdownDone <- cluster.Shutdown(context.Background())
+	}()
+	time.Sleep(100 * time.Millisecond)
+	s.Equal(ErrClusterClosed, cluster.WriterExec("select 1;"))
+	s.True(cluster.manager.master.getConnected())
+
+	close(master.block)
+	s.Nil(<-queryDone)
+	s.Nil(<-shutdownDone)
+	s.False(cluster.manager.master.getConnected())
+}
+
+func (s *ClusterShutdownTestSuite) TestWaitsForOpenTransactions() {
+	cluster := s.newCluster(&dummySQL{})
+	tx, err := cluster.NewTransaction()
+	s.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	s.Equal(context.DeadlineExceeded, cluster.Shutdown(ctx))
+	s.False(cluster.manager.master.getConnected())
+
+	// connections are killed, the transaction can only be finished to release its slot
+	s.Equal(ErrClusterClosed, tx.Exec("select 1;"))
+	s.Equal(ErrClusterClosed, tx.Query(nil, "select 1;"))
+	s.Equal(ErrClusterClosed, tx.Commit())
+	s.Nil(cluster.Shutdown(context.Background()))
+}
+
+func (s *ClusterShutdownTestSuite) TestSetMasterRetiresPreviousMaster() {
+	var closed int32
+	cluster := NewCluster(&Config{
+		ConnCheckDelay: 1 * time.Hour,
+		HealthCheck: func(ctx context.Context, node *Node) error {
+			return nil
+		},
+	})
+	cluster.manager.master = &connection{
+		connected:      1,
+		connCheckDelay: 1 * time.Hour,
+		s:              &dummySQL{},
+		quitChan:       make(chan struct{}),
+		closeFn: func() {
+			atomic.StoreInt32(&closed, 1)
+		},
+	}
+	previous := cluster.manager.master
+
+	tx, err := cluster.NewTransaction()
+	s.Nil(err)
+	s.Nil(cluster.SetMaster(&pg.Options{Addr: "pg-1:5432"}))
+	s.Equal("pg-1:5432", cluster.manager.getMaster().host)
+
+	// the open transaction keeps the previous pool until it finishes
+	s.Equal(int32(0), atomic.LoadInt32(&closed))
+	s.Nil(tx.Exec("select 1;"))
+	s.Nil(tx.Commit())
+	s.Equal(int32(1), atomic.LoadInt32(&closed))
+	s.True(previous.isDrained())
+	s.Nil(cluster.Shutdown(context.Background()))
+}
+
+func (s *ClusterShutdownTestSuite) TestRetiredAfterPickIsPickedAgain() {
+	retired := &connection{connected: 1, s: &dummySQL{}, quitChan: make(chan struct{})}
+	retired.retire()
+	s.Equal(errRetired, retired.beginWork())
+	_, err := retired.newTransaction(context.Background())
+	s.Equal(errRetired, err)
+
+	// the retired connection was picked before SetMaster replaced it
+	master := &dummySQL{}
+	picks := []*connection{retired, {connected: 1, s: master}}
+	err = onConnection(func() (*connection, error) {
+		conn := picks[0]
+		picks = picks[1:]
+		return conn, nil
+	}, func(conn *connection) error {
+		return conn.query(context.Background(), nil, "select 1;")
+	})
+	s.Nil(err)
+	s.True(master.queryRun)
+	s.False(retired.s.(*dummySQL).queryRun)
+}
+
+func (s *ClusterShutdownTestSuite) TestShutdownClosesRetiringConnections() {
+	var closed int32
+	cluster := NewCluster(&Config{
+		ConnCheckDelay: 1 * time.Hour,
+		HealthCheck: func(ctx context.Context, node *Node) error {
+			return nil
+		},
+	})
+	cluster.manager.master = &connection{
+		connected: 1,
+		s:         &dummySQL{},
+		quitChan:  make(chan struct{}),
+		closeFn: func() {
+			atomic.StoreInt32(&closed, 1)
+		},
+	}
+
+	_, err := cluster.NewTransaction()
+	s.Nil(err)
+	s.Nil(cluster.SetMaster(&pg.Options{Addr: "pg-1:5432"}))
+	s.Equal(int32(0), atomic.LoadInt32(&closed))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s.Equal(context.DeadlineExceeded, cluster.Shutdown(ctx))
+	s.Equal(int32(1), atomic.LoadInt32(&closed))
+}
+
+func (s *ClusterShutdownTestSuite) TestConcurrentShutdown() {
+	cluster := s.newCluster(&dummySQL{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Nil(cluster.Shutdown(context.Background()))
+		}()
+	}
+	wg.Wait()
+
+	s.True(cluster.manager.closed)
+	s.Equal(ErrClusterClosed, cluster.SetMaster(&pg.Options{}))
+	s.Equal(ErrClusterClosed, cluster.AddSlave(&pg.Options{}))
+	s.Equal(ErrClusterClosed, cluster.Query(nil, "select 1;"))
+	s.Equal(ErrClusterClosed, cluster.WriterExec("select 1;"))
+	s.Equal(ErrClusterClosed, cluster.WriterQuery(nil, "select 1;"))
+	_, err := cluster.NewTransaction()
+	s.Equal(ErrClusterClosed, err)
+}
@@ -0,0 +1,415 @@
+package hansip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-pg/pg"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const defaultEnvPrefix = "HANSIP"
+
+// ClusterConfig describes master, slaves and Config of a cluster.
+// It can be written by hand or loaded with LoadConfigFile and LoadConfigFromEnv.
+type ClusterConfig struct {
+	Master NodeConfig   `json:"master" yaml:"master" toml:"master"`
+	Slaves []NodeConfig `json:"slaves" yaml:"slaves" toml:"slaves"`
+
+	PrependQueryWithCaller  bool     `json:"prepend_query_with_caller" yaml:"prepend_query_with_caller" toml:"prepend_query_with_caller"`
+	MaxConnAttempt          int      `json:"max_conn_attempt" yaml:"max_conn_attempt" toml:"max_conn_attempt"`
+	ConnRetryDelay          Duration `json:"conn_retry_delay" yaml:"conn_retry_delay" toml:"conn_retry_delay"`
+	ConnCheckDelay          Duration `json:"conn_check_delay" yaml:"conn_check_delay" toml:"conn_check_delay"`
+	ConnPingTimeout         Duration `json:"conn_ping_timeout" yaml:"conn_ping_timeout" toml:"conn_ping_timeout"`
+	FailureThreshold        int      `json:"failure_threshold" yaml:"failure_threshold" toml:"failure_threshold"`
+	SuccessThreshold        int      `json:"success_threshold" yaml:"success_threshold" toml:"success_threshold"`
+	LazyConnect             bool     `json:"lazy_connect" yaml:"lazy_connect" toml:"lazy_connect"`
+	MaxCheckBackoff         Duration `json:"max_check_backoff" yaml:"max_check_backoff" toml:"max_check_backoff"`
+	ReservedTags            []string `json:"reserved_tags" yaml:"reserved_tags" toml:"reserved_tags"`
+	LocalZone               string   `json:"local_zone" yaml:"local_zone" toml:"local_zone"`
+	SaturationThreshold     int      `json:"saturation_threshold" yaml:"saturation_threshold" toml:"saturation_threshold"`
+	DefaultStatementTimeout Duration `json:"default_statement_timeout" yaml:"default_statement_timeout" toml:"default_statement_timeout"`
+
+	// Pool is merged into every node, see Config.Pool.
+	Pool *FilePoolConfig `json:"pool" yaml:"pool" toml:"pool"`
+	// TLS encrypts connections to every node, see Config.TLS.
+	TLS *FileTLSConfig `json:"tls" yaml:"tls" toml:"tls"`
+}
+
+// NodeConfig describes a single database server.
+type NodeConfig struct {
+	// URL of a slave may list comma separated hosts such as postgres://user:pass@h1:5432,h2:5432/db,
+	// every host becomes a slave with the settings of this node.
+	URL    string   `json:"url" yaml:"url" toml:"url"`
+	Weight int      `json:"weight" yaml:"weight" toml:"weight"`
+	Tags   []string `json:"tags" yaml:"tags" toml:"tags"`
+	// Pool overrides cluster wide pool settings for this node.
+	Pool *FilePoolConfig `json:"pool" yaml:"pool" toml:"pool"`
+	// ServerName overrides name used to verify certificate of this node.
+	ServerName string `json:"server_name" yaml:"server_name" toml:"server_name"`
+	Zone       string `json:"zone" yaml:"zone" toml:"zone"`
+}
+
+// Duration is a time.Duration written as a string such as "3s" or "500ms" in config files.
+type Duration time.Duration
+
+// UnmarshalText parses duration string, it is used for JSON, TOML and environment variables.
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// UnmarshalYAML parses duration string in YAML.
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(text))
+}
+
+// MarshalText formats duration as a string such as "3s".
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// LoadConfigFile reads ClusterConfig from a JSON, YAML or TOML file.
+// The format is picked by file extension: .json, .yaml, .yml or .toml.
+func LoadConfigFile(path string) (*ClusterConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &ClusterConfig{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(cc)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(content, cc)
+	case ".toml":
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(content), cc)
+		if undecoded := meta.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = fmt.Errorf("unknown field %q", undecoded[0].String())
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported config format %q", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cc, nil
+}
+
+// LoadConfigFromEnv reads ClusterConfig from environment variables with given prefix, "HANSIP" when empty.
+// Recognized variables are:
+//
+//	HANSIP_MASTER_URL          master url
+//	HANSIP_SLAVE_URLS          slave urls separated by whitespace or ";", commas belong to multi-host urls
+//	HANSIP_CONN_RETRY_DELAY    duration such as "3s"
+//	HANSIP_CONN_CHECK_DELAY    duration
+//	HANSIP_CONN_PING_TIMEOUT   duration
+//	HANSIP_MAX_CHECK_BACKOFF   duration
+//	HANSIP_MAX_CONN_ATTEMPT    integer
+//	HANSIP_FAILURE_THRESHOLD   integer
+//	HANSIP_SUCCESS_THRESHOLD   integer
+//	HANSIP_LAZY_CONNECT        boolean
+//	HANSIP_PREPEND_QUERY_WITH_CALLER boolean
+func LoadConfigFromEnv(prefix string) (*ClusterConfig, error) {
+	if prefix == "" {
+		prefix = defaultEnvPrefix
+	}
+	env := envReader{prefix: strings.TrimSuffix(prefix, "_") + "_"}
+
+	cc := &ClusterConfig{}
+	cc.Master.URL = env.lookup("MASTER_URL")
+	urls := strings.FieldsFunc(env.lookup("SLAVE_URLS"), func(r rune) bool {
+		return r == ';' || unicode.IsSpace(r)
+	})
+	for _, url := range urls {
+		cc.Slaves = append(cc.Slaves, NodeConfig{URL: url})
+	}
+
+	env.duration("CONN_RETRY_DELAY", &cc.ConnRetryDelay)
+	env.duration("CONN_CHECK_DELAY", &cc.ConnCheckDelay)
+	env.duration("CONN_PING_TIMEOUT", &cc.ConnPingTimeout)
+	env.duration("MAX_CHECK_BACKOFF", &cc.MaxCheckBackoff)
+	env.int("MAX_CONN_ATTEMPT", &cc.MaxConnAttempt)
+	env.int("FAILURE_THRESHOLD", &cc.FailureThreshold)
+	env.int("SUCCESS_THRESHOLD", &cc.SuccessThreshold)
+	env.bool("LAZY_CONNECT", &cc.LazyConnect)
+	env.bool("PREPEND_QUERY_WITH_CALLER", &cc.PrependQueryWithCaller)
+	if env.err != nil {
+		return nil, env.err
+	}
+	return cc, nil
+}
+
+// Validate checks that cc describes a usable cluster.
+func (cc *ClusterConfig) Validate() error {
+	if cc.Master.URL == "" {
+		return errors.New("master: url is required")
+	}
+	if err := cc.Master.validate(); err != nil {
+		return fmt.Errorf("master: %w", err)
+	}
+	if hosts, _ := cc.Master.hosts(); len(hosts) > 1 {
+		return errors.New("master: url must have a single host, only slave urls may list several")
+	}
+	for i, slave := range cc.Slaves {
+		if err := slave.validate(); err != nil {
+			return fmt.Errorf("slaves[%d]: %w", i, err)
+		}
+	}
+
+	durations := []struct {
+		name  string
+		value Duration
+	}{
+		{"conn_retry_delay", cc.ConnRetryDelay},
+		{"conn_check_delay", cc.ConnCheckDelay},
+		{"conn_ping_timeout", cc.ConnPingTimeout},
+		{"max_check_backoff", cc.MaxCheckBackoff},
+		{"default_statement_timeout", cc.DefaultStatementTimeout},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			return fmt.Errorf("%s: must not be negative, got %s", d.name, time.Duration(d.value))
+		}
+	}
+
+	ints := []struct {
+		name  string
+		value int
+	}{
+		{"max_conn_attempt", cc.MaxConnAttempt},
+		{"failure_threshold", cc.FailureThreshold},
+		{"success_threshold", cc.SuccessThreshold},
+		{"saturation_threshold", cc.SaturationThreshold},
+	}
+	for _, i := range ints {
+		if i.value < 0 {
+			return fmt.Errorf("%s: must not be negative, got %d", i.name, i.value)
+		}
+	}
+
+	if err := cc.Pool.validate(); err != nil {
+		return fmt.Errorf("pool: %w", err)
+	}
+	if err := cc.TLS.validate(); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	return nil
+}
+
+// Config returns cluster wide settings of cc.
+func (cc *ClusterConfig) Config() *Config {
+	conf := &Config{}
+	cc.applyTo(conf)
+	return conf
+}
+
+// applyTo overrides settings of conf which can be written in ClusterConfig,
+// pool and tls are only overridden when cc has those sections.
+func (cc *ClusterConfig) applyTo(conf *Config) {
+	conf.PrependQueryWithCaller = cc.PrependQueryWithCaller
+	conf.MaxConnAttempt = cc.MaxConnAttempt
+	conf.ConnRetryDelay = time.Duration(cc.ConnRetryDelay)
+	conf.ConnCheckDelay = time.Duration(cc.ConnCheckDelay)
+	conf.ConnPingTimeout = time.Duration(cc.ConnPingTimeout)
+	conf.FailureThreshold = cc.FailureThreshold
+	conf.SuccessThreshold = cc.SuccessThreshold
+	conf.LazyConnect = cc.LazyConnect
+	conf.MaxCheckBackoff = time.Duration(cc.MaxCheckBackoff)
+	conf.ReservedTags = cc.ReservedTags
+	conf.LocalZone = cc.LocalZone
+	conf.SaturationThreshold = cc.SaturationThreshold
+	conf.DefaultStatementTimeout = time.Duration(cc.DefaultStatementTimeout)
+	if cc.Pool != nil {
+		conf.Pool = cc.Pool.PoolConfig()
+	}
+	if cc.TLS != nil {
+		conf.TLS = cc.TLS.TLSConfig()
+	}
+}
+
+func (nc NodeConfig) validate() error {
+	if nc.URL == "" {
+		return errors.New("url is required")
+	}
+	if _, err := nc.hosts(); err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if nc.Weight < 0 {
+		return fmt.Errorf("weight must not be negative, got %d", nc.Weight)
+	}
+	if err := nc.Pool.validate(); err != nil {
+		return fmt.Errorf("pool: %w", err)
+	}
+	return nil
+}
+
+// hosts parses url of nc, a libpq style url with comma separated hosts gives options of every host.
+func (nc NodeConfig) hosts() ([]*pg.Options, error) {
+	if !strings.Contains(nc.URL, ",") {
+		opts, err := pg.ParseURL(nc.URL)
+		if err != nil {
+			return nil, err
+		}
+		return []*pg.Options{opts}, nil
+	}
+
+	hosts, attrs, err := parseMultiHostURL(nc.URL)
+	if err != nil {
+		return nil, err
+	}
+	if attrs != sessionAttrsAny {
+		return nil, fmt.Errorf("target_session_attrs=%s is only supported by NewClusterFromURL", attrs)
+	}
+	return hosts, nil
+}
+
+// options returns options of every host of nc and node options shared by them.
+func (nc NodeConfig) options() ([]*pg.Options, []NodeOption, error) {
+	hosts, err := nc.hosts()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var nodeOpts []NodeOption
+	if nc.Weight > 0 {
+		nodeOpts = append(nodeOpts, Weight(nc.Weight))
+	}
+	if len(nc.Tags) > 0 {
+		nodeOpts = append(nodeOpts, Tags(nc.Tags...))
+	}
+	if nc.Pool != nil {
+		nodeOpts = append(nodeOpts, Pool(nc.Pool.PoolConfig()))
+	}
+	if nc.ServerName != "" {
+		nodeOpts = append(nodeOpts, ServerName(nc.ServerName))
+	}
+	if nc.Zone != "" {
+		nodeOpts = append(nodeOpts, Zone(nc.Zone))
+	}
+	return hosts, nodeOpts, nil
+}
+
+// NewClusterFromConfig validates cc, creates a cluster and connects to all nodes in it.
+func NewClusterFromConfig(cc *ClusterConfig) (*Cluster, error) {
+	if err := cc.Validate(); err != nil {
+		return nil, err
+	}
+
+	cluster := NewCluster(cc.Config())
+	if err := cluster.applyNodes(cc); err != nil {
+		cluster.Shutdown(context.Background())
+		return nil, err
+	}
+	return cluster, nil
+}
+
+// NewClusterFromFile loads ClusterConfig from given file and creates a cluster from it.
+func NewClusterFromFile(path string) (*Cluster, error) {
+	cc, err := LoadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewClusterFromConfig(cc)
+}
+
+// applyNodes makes master and slaves from ClusterConfig match cc.
+// Master is replaced when its url or options other than weight change, slaves are identified by url,
+// tags and host, a slave url listing several hosts adds a slave for each of them.
+func (c *Cluster) applyNodes(cc *ClusterConfig) error {
+	c.reloadMutex.Lock()
+	defer c.reloadMutex.Unlock()
+
+	hosts, nodeOpts, err := cc.Master.options()
+	if err != nil {
+		return fmt.Errorf("master: %w", err)
+	}
+	if masterOpts := newNodeOptions(nodeOpts); cc.Master.URL != c.configMaster || !masterOpts.sameNode(c.configMasterOpts) {
+		if err := c.SetMaster(hosts[0], nodeOpts...); err != nil {
+			return fmt.Errorf("master: %w", err)
+		}
+		c.configMaster = cc.Master.URL
+		c.configMasterOpts = masterOpts
+	}
+
+	desired := make(map[string]*nodeSpec, len(cc.Slaves))
+	for i, slave := range cc.Slaves {
+		hosts, nodeOpts, err := slave.options()
+		if err != nil {
+			return fmt.Errorf("slaves[%d]: %w", i, err)
+		}
+		for _, opts := range hosts {
+			desired[slave.URL+"#"+strings.Join(slave.Tags, ",")+"#"+opts.Addr] = &nodeSpec{
+				options:  opts,
+				nodeOpts: nodeOpts,
+			}
+		}
+	}
+	if err := c.configSlaves.reconcile(desired); err != nil {
+		return fmt.Errorf("slaves: %w", err)
+	}
+	return nil
+}
+
+// envReader reads prefixed environment variables, keeping the first error it encounters.
+type envReader struct {
+	prefix string
+	err    error
+}
+
+func (r *envReader) lookup(name string) string {
+	return strings.TrimSpace(os.Getenv(r.prefix + name))
+}
+
+func (r *envReader) duration(name string, dest *Duration) {
+	if val := r.lookup(name); val != "" && r.err == nil {
+		if err := dest.UnmarshalText([]byte(val)); err != nil {
+			r.err = fmt.Errorf("%s%s: %w", r.prefix, name, err)
+		}
+	}
+}
+
+func (r *envReader) int(name string, dest *int) {
+	if val := r.lookup(name); val != "" && r.err == nil {
+		parsed, err := strconv.Atoi(val)
+		if err != nil {
+			r.err = fmt.Errorf("%s%s: %w", r.prefix, name, err)
+			return
+		}
+		*dest = parsed
+	}
+}
+
+func (r *envReader) bool(name string, dest *bool) {
+	if val := r.lookup(name); val != "" && r.err == nil {
+		parsed, err := strconv.ParseBool(val)
+		if err != nil {
+			r.err = fmt.Errorf("%s%s: %w", r.prefix, name, err)
+			return
+		}
+		*dest = parsed
+	}
+}
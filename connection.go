@@ -1,7 +1,11 @@
 package hansip
 
 import (
+	"context"
 	"errors"
+	"io"
+	"math/rand"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -10,52 +14,134 @@ import (
 
 var errPingTimeout = errors.New("ping timeout")
 
+// errRetired is returned by connections retired after they were picked, the caller picks another connection.
+var errRetired = errors.New("connection is retired")
+
 // connection abstracts connection to a database server.
 // it handles connection updates by pinging the server every connTickDelay.
 type connection struct {
 	host string
+	// RoleMaster or RoleSlave, reported in errors
+	role string
+	tags []string
+	zone string
 	s    sql
 
+	// number of reads running on this connection, used to detect saturation
+	inflight int32
+
+	// guards settings below, they can be changed by Cluster.Reload while loop is running
+	settingsMutex  sync.RWMutex
+	weight         int
 	pingTimeout    time.Duration
 	connCheckDelay time.Duration
 
-	pingFn      func() error
+	// number of consecutive ping results needed to flip connected status
+	failureThreshold int
+	successThreshold int
+	// when positive, nodes that are down are checked with exponential backoff up to maxCheckBackoff
+	maxCheckBackoff time.Duration
+	// bounds queries without timeout of their own, zero for no bound
+	statementTimeout time.Duration
+
+	// consecutive ping results, only touched by updateStatus
+	failures  int
+	successes int
+
+	pingFn      func(ctx context.Context) error
 	pingRunning int32
 	closeFn     func()
 
+	// set when Config.CredentialProvider is used
+	credentials *nodeCredentials
+
+	// result of last ping, reported by Cluster.Health
+	statusMutex sync.RWMutex
+	lastErr     error
+
 	// 1 for connected, 0 for not
 	connected int32
 
-	closed   bool
-	quitChan chan struct{}
+	// running statements and open transactions, a retired connection is closed once they are done
+	workMutex sync.Mutex
+	work      int
+	retired   bool
+
+	closed    bool
+	closeOnce sync.Once
+	stopOnce  sync.Once
+	quitChan  chan struct{}
+	// wakes loop up to pick up new settings
+	resetChan chan struct{}
 }
 
 // create a new connection instance
 // and start loop in background to update connection status
-func newConnection(options *pg.Options, pingTimeout, connCheckDelay time.Duration) (*connection, error) {
-	db := pg.Connect(options)
+func newConnection(options *pg.Options, conf *Config, nodeOpts *nodeOptions) (*connection, error) {
+	options = nodePoolOptions(options, conf.Pool, nodeOpts.pool)
+	options, err := nodeTLSOptions(options, conf.TLS, nodeOpts.serverName)
+	if err != nil {
+		return nil, err
+	}
+	s := &gopgSQL{}
 	conn := &connection{
-		host: options.Addr,
-		s: &gopgSQL{
-			db: db,
-		},
-		pingTimeout:    pingTimeout,
-		connCheckDelay: connCheckDelay,
-		quitChan:       make(chan struct{}),
-		pingFn: func() error {
-			_, err := db.Exec("select 1;")
+		host:             options.Addr,
+		role:             RoleSlave,
+		weight:           nodeOpts.weight,
+		tags:             nodeOpts.tags,
+		zone:             nodeOpts.zone,
+		s:                s,
+		pingTimeout:      conf.ConnPingTimeout,
+		connCheckDelay:   conf.ConnCheckDelay,
+		failureThreshold: conf.FailureThreshold,
+		successThreshold: conf.SuccessThreshold,
+		maxCheckBackoff:  conf.MaxCheckBackoff,
+		statementTimeout: conf.DefaultStatementTimeout,
+		quitChan:         make(chan struct{}),
+		resetChan:        make(chan struct{}, 1),
+	}
+
+	// with a credential provider the pool is created, and rebuilt, on first credentials refresh
+	if conf.CredentialProvider != nil {
+		conn.credentials = newNodeCredentials(conf.CredentialProvider, options, s)
+		conn.closeFn = conn.credentials.close
+	} else {
+		s.setDB(pg.Connect(options))
+		conn.closeFn = s.close
+	}
+
+	healthCheck := conf.HealthCheck
+	if healthCheck == nil {
+		healthCheck = HealthCheckQuery(defaultHealthCheckQuery)
+	}
+	conn.pingFn = func(ctx context.Context) error {
+		if conn.credentials != nil {
+			if err := conn.credentials.refresh(ctx); err != nil {
+				return err
+			}
+		}
+		db, release, err := s.use()
+		if err != nil {
 			return err
-		},
-		closeFn: func() {
-			db.Close()
-		},
+		}
+		defer release()
+		return healthCheck(ctx, &Node{
+			Host: options.Addr,
+			DB:   db,
+		})
 	}
 
-	// check if connection is working
+	// check if connection is working.
+	// in lazy mode a node that is down is kept and the loop keeps probing it.
 	if err := conn.ping(); err != nil {
-		return nil, err
+		if !conf.LazyConnect {
+			conn.closeFn()
+			return nil, err
+		}
+		conn.failures = 1
+	} else {
+		conn.setConnected(true)
 	}
-	conn.updateStatus()
 
 	// start main loop
 	go conn.loop()
@@ -64,22 +150,50 @@ func newConnection(options *pg.Options, pingTimeout, connCheckDelay time.Duratio
 }
 
 func (c *connection) ping() error {
+	// a check ignoring its ctx may still run from a previous ping, the node is not answering in time
 	if !atomic.CompareAndSwapInt32(&c.pingRunning, 0, 1) {
-		return nil
+		return errPingTimeout
 	}
-	defer atomic.StoreInt32(&c.pingRunning, 0)
 
-	errChan := make(chan error)
+	c.settingsMutex.RLock()
+	timeout := c.pingTimeout
+	c.settingsMutex.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// pingFn runs in its own goroutine so a check which does not give up once ctx is done
+	// can not block loop, go-pg cancels running query on the server when its context is done.
+	result := make(chan error, 1)
 	go func() {
-		errChan <- c.pingFn()
+		defer atomic.StoreInt32(&c.pingRunning, 0)
+		result <- c.pingFn(ctx)
 	}()
 
+	var err error
 	select {
-	case <-time.After(c.pingTimeout):
-		return errPingTimeout
-	case err := <-errChan:
-		return err
+	case err = <-result:
+		if ctx.Err() == context.DeadlineExceeded {
+			err = errPingTimeout
+		}
+	case <-ctx.Done():
+		err = errPingTimeout
+	}
+
+	// rejected credentials are fetched again instead of being served from cache
+	if c.credentials != nil && IsAuthError(err) {
+		c.credentials.invalidate()
 	}
+	c.statusMutex.Lock()
+	c.lastErr = err
+	c.statusMutex.Unlock()
+	return err
+}
+
+func (c *connection) getLastErr() error {
+	c.statusMutex.RLock()
+	defer c.statusMutex.RUnlock()
+	return c.lastErr
 }
 
 func (c *connection) getConnected() bool {
@@ -95,33 +209,267 @@ func (c *connection) setConnected(connected bool) {
 }
 
 func (c *connection) loop() {
-	ticker := time.NewTicker(c.connCheckDelay)
+	timer := time.NewTimer(c.nextCheckDelay())
+	defer timer.Stop()
 	for {
 		select {
-		case <-ticker.C:
+		case <-timer.C:
 			c.updateStatus()
+			timer.Reset(c.nextCheckDelay())
+		case <-c.resetChan:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(c.nextCheckDelay())
 		case <-c.quitChan:
 			return
 		}
 	}
 }
 
+// updateStatus pings the server and flips connected status
+// once enough consecutive pings agree with each other.
 func (c *connection) updateStatus() {
-	connected := c.ping() == nil
-	c.setConnected(connected)
-}
+	c.settingsMutex.RLock()
+	failureThreshold, successThreshold := c.failureThreshold, c.successThreshold
+	c.settingsMutex.RUnlock()
 
-func (c *connection) quit() {
-	if c.closed {
+	if c.ping() == nil {
+		c.failures = 0
+		c.successes++
+		if c.successes >= successThreshold {
+			c.setConnected(true)
+		}
 		return
 	}
 
-	// stop loop
-	c.quitChan <- struct{}{}
+	c.successes = 0
+	c.failures++
+	if c.failures >= failureThreshold {
+		c.setConnected(false)
+	}
+}
+
+// nextCheckDelay returns how long to wait before next status update.
+// nodes that are down back off exponentially with jitter, so a long outage
+// does not get hammered by every node checking at the same pace.
+func (c *connection) nextCheckDelay() time.Duration {
+	c.settingsMutex.RLock()
+	delay, maxBackoff := c.connCheckDelay, c.maxCheckBackoff
+	c.settingsMutex.RUnlock()
+
+	if maxBackoff <= 0 || c.getConnected() {
+		return delay
+	}
+
+	for i := 1; i < c.failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	// pick a random delay between half and full of the backoff
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+func (c *connection) getInflight() int {
+	return int(atomic.LoadInt32(&c.inflight))
+}
+
+// getStatementTimeout returns timeout of ctx, or default timeout of the connection when ctx has none.
+func (c *connection) getStatementTimeout(ctx context.Context) time.Duration {
+	if timeout, ok := statementTimeoutFromContext(ctx); ok {
+		return timeout
+	}
+	c.settingsMutex.RLock()
+	defer c.settingsMutex.RUnlock()
+	return c.statementTimeout
+}
+
+// query runs query on the connection and keeps track of running queries.
+func (c *connection) query(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	if err := c.beginWork(); err != nil {
+		return err
+	}
+	defer c.endWork()
+	atomic.AddInt32(&c.inflight, 1)
+	defer atomic.AddInt32(&c.inflight, -1)
+	err := runWithTimeout(ctx, c.host, c.getStatementTimeout(ctx), func(ctx context.Context) error {
+		return c.s.query(ctx, dest, query, args...)
+	})
+	return c.wrapError("query", err)
+}
+
+func (c *connection) exec(ctx context.Context, query string, args ...interface{}) error {
+	if err := c.beginWork(); err != nil {
+		return err
+	}
+	defer c.endWork()
+	err := runWithTimeout(ctx, c.host, c.getStatementTimeout(ctx), func(ctx context.Context) error {
+		return c.s.exec(ctx, query, args...)
+	})
+	return c.wrapError("exec", err)
+}
+
+func (c *connection) copyFrom(ctx context.Context, r io.Reader, query string, args ...interface{}) (int, error) {
+	if err := c.beginWork(); err != nil {
+		return 0, err
+	}
+	defer c.endWork()
+	var rows int
+	err := runWithTimeout(ctx, c.host, c.getStatementTimeout(ctx), func(ctx context.Context) error {
+		var err error
+		rows, err = c.s.copyFrom(ctx, r, query, args...)
+		return err
+	})
+	return rows, c.wrapError("copy from", err)
+}
+
+func (c *connection) copyTo(ctx context.Context, w io.Writer, query string, args ...interface{}) (int, error) {
+	if err := c.beginWork(); err != nil {
+		return 0, err
+	}
+	defer c.endWork()
+	atomic.AddInt32(&c.inflight, 1)
+	defer atomic.AddInt32(&c.inflight, -1)
+	var rows int
+	err := runWithTimeout(ctx, c.host, c.getStatementTimeout(ctx), func(ctx context.Context) error {
+		var err error
+		rows, err = c.s.copyTo(ctx, w, query, args...)
+		return err
+	})
+	return rows, c.wrapError("copy to", err)
+}
+
+// batch runs statements like exec, the statement which failed the batch gets the wrapped error.
+func (c *connection) batch(ctx context.Context, statements []batchStatement) ([]BatchResult, error) {
+	if err := c.beginWork(); err != nil {
+		return nil, err
+	}
+	defer c.endWork()
+	atomic.AddInt32(&c.inflight, 1)
+	defer atomic.AddInt32(&c.inflight, -1)
+	var results []BatchResult
+	err := runWithTimeout(ctx, c.host, c.getStatementTimeout(ctx), func(ctx context.Context) error {
+		var err error
+		results, err = c.s.batch(ctx, statements)
+		return err
+	})
+	err = c.wrapError("batch", err)
+	for i := range results {
+		if results[i].Err != nil && results[i].Err != ErrBatchAborted {
+			results[i].Err = err
+		}
+	}
+	return results, err
+}
+
+// newTransaction begins a transaction which applies statement timeout with SET LOCAL.
+func (c *connection) newTransaction(ctx context.Context) (CopyTransaction, error) {
+	timeout := c.getStatementTimeout(ctx)
+	if err := c.beginWork(); err != nil {
+		return nil, err
+	}
+	tx, err := c.s.newTransaction(WithStatementTimeout(ctx, timeout))
+	if err != nil {
+		c.endWork()
+		return nil, c.wrapError("begin", err)
+	}
+	return &nodeTransaction{
+		CopyTransaction: tx,
+		conn:            c,
+		timeout:         timeout,
+	}, nil
+}
+
+func (c *connection) getWeight() int {
+	c.settingsMutex.RLock()
+	defer c.settingsMutex.RUnlock()
+	return c.weight
+}
+
+func (c *connection) setWeight(weight int) {
+	c.settingsMutex.Lock()
+	c.weight = weight
+	c.settingsMutex.Unlock()
+}
+
+// applyConfig changes timings of a running connection, loop picks them up right away.
+func (c *connection) applyConfig(conf *Config) {
+	c.settingsMutex.Lock()
+	c.pingTimeout = conf.ConnPingTimeout
+	c.connCheckDelay = conf.ConnCheckDelay
+	c.failureThreshold = conf.FailureThreshold
+	c.successThreshold = conf.SuccessThreshold
+	c.maxCheckBackoff = conf.MaxCheckBackoff
+	c.statementTimeout = conf.DefaultStatementTimeout
+	c.settingsMutex.Unlock()
+
+	select {
+	case c.resetChan <- struct{}{}:
+	default:
+	}
+}
+
+// beginWork counts a statement or transaction running on the connection until endWork.
+// It fails with errRetired once the connection is retired, its pool may be closed already.
+func (c *connection) beginWork() error {
+	c.workMutex.Lock()
+	defer c.workMutex.Unlock()
+	if c.retired {
+		return errRetired
+	}
+	c.work++
+	return nil
+}
 
-	if c.closeFn != nil {
-		c.closeFn()
+func (c *connection) endWork() {
+	c.workMutex.Lock()
+	c.work--
+	drained := c.retired && c.work == 0
+	c.workMutex.Unlock()
+	if drained {
+		c.quit()
 	}
-	c.setConnected(false)
-	c.closed = true
+}
+
+// retire stops health checks of a connection which receives no new work anymore,
+// its pool is closed once running statements and open transactions are done.
+func (c *connection) retire() {
+	c.stop()
+	c.workMutex.Lock()
+	c.retired = true
+	drained := c.work == 0
+	c.workMutex.Unlock()
+	if drained {
+		c.quit()
+	}
+}
+
+// isDrained tells whether a retired connection has no work left.
+func (c *connection) isDrained() bool {
+	c.workMutex.Lock()
+	defer c.workMutex.Unlock()
+	return c.retired && c.work == 0
+}
+
+// stop stops loop, closing does not wait for loop to be back from a running check.
+func (c *connection) stop() {
+	c.stopOnce.Do(func() {
+		close(c.quitChan)
+	})
+}
+
+func (c *connection) quit() {
+	c.closeOnce.Do(func() {
+		c.stop()
+
+		if c.closeFn != nil {
+			c.closeFn()
+		}
+		c.setConnected(false)
+		c.closed = true
+	})
 }
@@ -3,6 +3,7 @@ package hansip
 import (
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,12 +13,25 @@ type connectionManager struct {
 	master       *connection
 	slaves       []*connection
 	activeSlaves []*connection
-	mutex        sync.RWMutex
+	// consistent hash ring of activeSlaves, rebuilt together with them
+	ring  *hashRing
+	mutex sync.RWMutex
 
 	connCheckDelay time.Duration
 
-	closed   bool
-	quitChan chan struct{}
+	// readers in localZone are preferred until they have saturationThreshold running queries each
+	localZone           string
+	saturationThreshold int
+	crossZoneReads      uint64
+
+	// replaced or removed connections waiting for their work to finish, Shutdown closes them right away
+	retiring []*connection
+
+	closed    bool
+	closeOnce sync.Once
+	quitChan  chan struct{}
+	// wakes loop up to pick up new connCheckDelay
+	resetChan chan struct{}
 }
 
 func newConnectionManager(connCheckDelay time.Duration) *connectionManager {
@@ -25,23 +39,82 @@ func newConnectionManager(connCheckDelay time.Duration) *connectionManager {
 		slaves:         []*connection{},
 		connCheckDelay: connCheckDelay,
 		quitChan:       make(chan struct{}),
+		resetChan:      make(chan struct{}, 1),
 	}
 	go manager.loop()
 	return manager
 }
 
 func (m *connectionManager) loop() {
-	ticker := time.NewTicker(m.connCheckDelay)
+	ticker := time.NewTicker(m.getConnCheckDelay())
+	defer func() {
+		ticker.Stop()
+	}()
 	for {
 		select {
 		case <-ticker.C:
 			m.updateActiveSlaves()
+		case <-m.resetChan:
+			ticker.Stop()
+			ticker = time.NewTicker(m.getConnCheckDelay())
 		case <-m.quitChan:
 			return
 		}
 	}
 }
 
+func (m *connectionManager) getConnCheckDelay() time.Duration {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.connCheckDelay
+}
+
+// setConnCheckDelay changes how often active slaves are updated, loop picks it up right away.
+func (m *connectionManager) setConnCheckDelay(delay time.Duration) {
+	m.mutex.Lock()
+	m.connCheckDelay = delay
+	m.mutex.Unlock()
+
+	select {
+	case m.resetChan <- struct{}{}:
+	default:
+	}
+}
+
+// setLocality changes zone preference of readers.
+func (m *connectionManager) setLocality(localZone string, saturationThreshold int) {
+	m.mutex.Lock()
+	m.localZone = localZone
+	m.saturationThreshold = saturationThreshold
+	m.mutex.Unlock()
+}
+
+func (m *connectionManager) getLocality() (string, int) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.localZone, m.saturationThreshold
+}
+
+func (m *connectionManager) getCrossZoneReads() uint64 {
+	return atomic.LoadUint64(&m.crossZoneReads)
+}
+
+func (m *connectionManager) getMaster() *connection {
+	m.mutex.RLock()
+	master := m.master
+	m.mutex.RUnlock()
+	return master
+}
+
+// setMaster replaces master connection and returns the previous one.
+func (m *connectionManager) setMaster(conn *connection) *connection {
+	m.mutex.Lock()
+	previous := m.master
+	m.master = conn
+	m.mutex.Unlock()
+	return previous
+}
+
 func (m *connectionManager) getSlaves() []*connection {
 	m.mutex.RLock()
 	slaves := m.slaves
@@ -57,6 +130,38 @@ func (m *connectionManager) addSlave(conn *connection) {
 	m.updateActiveSlaves()
 }
 
+func (m *connectionManager) removeSlave(conn *connection) {
+	m.mutex.Lock()
+	slaves := make([]*connection, 0, len(m.slaves))
+	for _, slave := range m.slaves {
+		if slave != conn {
+			slaves = append(slaves, slave)
+		}
+	}
+	m.slaves = slaves
+	m.mutex.Unlock()
+
+	m.updateActiveSlaves()
+}
+
+func (m *connectionManager) hasSlave(host string) bool {
+	for _, conn := range m.getSlaves() {
+		if conn.host == host {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *connectionManager) isActiveSlave(conn *connection) bool {
+	for _, slave := range m.getActiveSlaves() {
+		if slave == conn {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *connectionManager) getActiveSlaves() []*connection {
 	m.mutex.RLock()
 	slaves := m.activeSlaves
@@ -65,17 +170,22 @@ func (m *connectionManager) getActiveSlaves() []*connection {
 }
 
 func (m *connectionManager) setActiveSlaves(slaves []*connection) {
+	ring := newHashRing(slaves)
+
 	m.mutex.Lock()
 	m.activeSlaves = slaves
+	m.ring = ring
 	m.mutex.Unlock()
 }
 
+func (m *connectionManager) getRing() *hashRing {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.ring
+}
+
 func (m *connectionManager) updateActiveSlaves() {
 	current := m.getSlaves()
-	if len(current) == 0 {
-		return
-	}
-
 	slaves := make([]*connection, 0, len(current))
 	for _, conn := range current {
 		if conn.getConnected() {
@@ -85,36 +195,143 @@ func (m *connectionManager) updateActiveSlaves() {
 	m.setActiveSlaves(slaves)
 }
 
-func (m *connectionManager) reader() sql {
+// pickReader picks one of active slaves accepted by match, nil match accepts every slave.
+// nil is returned when no slave is accepted.
+// When a local zone is set, slaves in it are preferred until they are all down or saturated.
+func (m *connectionManager) pickReader(match func(conn *connection) bool) *connection {
 	current := m.getActiveSlaves()
-	n := len(current)
-	if n == 0 {
-		return m.writer()
+	if match != nil {
+		matched := make([]*connection, 0, len(current))
+		for _, conn := range current {
+			if match(conn) {
+				matched = append(matched, conn)
+			}
+		}
+		current = matched
+	}
+	if len(current) == 0 {
+		return nil
+	}
+
+	localZone, threshold := m.getLocality()
+	if localZone == "" {
+		return pickWeighted(current)
+	}
+	conn := pickWeighted(preferLocal(current, localZone, threshold))
+	if conn.zone != localZone {
+		atomic.AddUint64(&m.crossZoneReads, 1)
+	}
+	return conn
+}
+
+// preferLocal narrows conns down to unsaturated ones in localZone, then to unsaturated ones in any zone.
+// conns are returned as they are when all of them are saturated.
+func preferLocal(conns []*connection, localZone string, threshold int) []*connection {
+	saturated := func(conn *connection) bool {
+		return threshold > 0 && conn.getInflight() >= threshold
+	}
+
+	local := make([]*connection, 0, len(conns))
+	available := make([]*connection, 0, len(conns))
+	for _, conn := range conns {
+		if saturated(conn) {
+			continue
+		}
+		available = append(available, conn)
+		if conn.zone == localZone {
+			local = append(local, conn)
+		}
+	}
+	if len(local) > 0 {
+		return local
+	}
+	if len(available) > 0 {
+		return available
+	}
+	return conns
+}
+
+// pickWeighted randomly picks a connection, connections with higher weight are picked more often.
+// connections without weight are treated as having weight of 1.
+func pickWeighted(conns []*connection) *connection {
+	total := 0
+	for _, conn := range conns {
+		total += weightOf(conn)
 	}
-	return current[rand.Intn(n)].s
+
+	n := rand.Intn(total)
+	for _, conn := range conns {
+		n -= weightOf(conn)
+		if n < 0 {
+			return conn
+		}
+	}
+	return conns[len(conns)-1]
+}
+
+func weightOf(conn *connection) int {
+	weight := conn.getWeight()
+	if weight <= 0 {
+		return defaultWeight
+	}
+	return weight
 }
 
 func (m *connectionManager) writer() sql {
-	if !m.master.getConnected() {
-		return nil
+	if master := m.writerConnection(); master != nil {
+		return master.s
 	}
-	return m.master.s
+	return nil
 }
 
-func (m *connectionManager) quit() {
-	if m.closed {
-		return
+// writerConnection returns master when it is connected.
+func (m *connectionManager) writerConnection() *connection {
+	master := m.getMaster()
+	if master == nil || !master.getConnected() {
+		return nil
 	}
+	return master
+}
 
-	// stop loop
-	m.quitChan <- struct{}{}
+// retire closes conn once work running on it is done, conn must not be handed out anymore.
+func (m *connectionManager) retire(conn *connection) {
+	conn.retire()
 
-	if m.master != nil {
-		m.master.quit()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	retiring := make([]*connection, 0, len(m.retiring)+1)
+	for _, c := range m.retiring {
+		if !c.isDrained() {
+			retiring = append(retiring, c)
+		}
 	}
-	for _, conn := range m.slaves {
-		conn.quit()
+	if !conn.isDrained() {
+		retiring = append(retiring, conn)
 	}
-	m.updateActiveSlaves()
-	m.closed = true
+	m.retiring = retiring
+}
+
+func (m *connectionManager) getRetiring() []*connection {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.retiring
+}
+
+func (m *connectionManager) quit() {
+	m.closeOnce.Do(func() {
+		// stop loop
+		m.quitChan <- struct{}{}
+
+		if master := m.getMaster(); master != nil {
+			master.quit()
+		}
+		for _, conn := range m.getSlaves() {
+			conn.quit()
+		}
+		for _, conn := range m.getRetiring() {
+			conn.quit()
+		}
+		m.updateActiveSlaves()
+		m.closed = true
+	})
 }
@@ -1,6 +1,8 @@
 package hansip
 
 import (
+	"context"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -33,21 +35,18 @@ func (s *ConnectionManagerTestSuite) TestAddSlave() {
 	s.Len(manager.getActiveSlaves(), 1)
 }
 
-func (s *ConnectionManagerTestSuite) TestReader() {
+func (s *ConnectionManagerTestSuite) TestPickReader() {
 	manager := s.newIdleConnectionManager()
 	manager.addSlave(&connection{
 		connected: 1,
 		s:         &dummySQL{},
 	})
-	s.NotNil(manager.reader())
+	s.NotNil(manager.pickReader(nil))
 
-	// goes to master when no reader available
+	// nothing to pick when no reader available
 	manager.slaves[0].setConnected(false)
-	manager.master = &connection{
-		connected: 1,
-		s:         &dummySQL{},
-	}
-	s.NotNil(manager.reader())
+	manager.updateActiveSlaves()
+	s.Nil(manager.pickReader(nil))
 }
 
 func (s *ConnectionManagerTestSuite) TestWriter() {
@@ -64,7 +63,7 @@ func (s *ConnectionManagerTestSuite) TestLoopAndQuit() {
 		connected:      1,
 		pingTimeout:    1 * time.Second,
 		connCheckDelay: 100 * time.Millisecond,
-		pingFn: func() error {
+		pingFn: func(ctx context.Context) error {
 			return nil
 		},
 		quitChan: make(chan struct{}),
@@ -84,3 +83,60 @@ func (s *ConnectionManagerTestSuite) TestLoopAndQuit() {
 	s.False(conn.getConnected())
 	s.True(manager.closed)
 }
+
+func (s *ConnectionManagerTestSuite) TestDisconnectedSlaveJoinsWhenUp() {
+	var up int32
+	conn := &connection{
+		pingTimeout:    1 * time.Second,
+		connCheckDelay: 100 * time.Millisecond,
+		pingFn: func(ctx context.Context) error {
+			if atomic.LoadInt32(&up) == 1 {
+				return nil
+			}
+			return errPingTimeout
+		},
+		quitChan: make(chan struct{}),
+	}
+	go conn.loop()
+
+	manager := s.newIdleConnectionManager()
+	manager.addSlave(conn)
+	go manager.loop()
+	s.Len(manager.getActiveSlaves(), 0)
+	s.Nil(manager.writer())
+
+	atomic.StoreInt32(&up, 1)
+	time.Sleep(300 * time.Millisecond)
+	s.Len(manager.getActiveSlaves(), 1)
+
+	manager.quit()
+}
+
+func (s *ConnectionManagerTestSuite) TestPickWeighted() {
+	light := &connection{host: "light"}
+	heavy := &connection{host: "heavy", weight: 3}
+	conns := []*connection{light, heavy}
+
+	picked := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		picked[pickWeighted(conns).host]++
+	}
+	s.InDelta(1000, picked["light"], 200)
+	s.InDelta(3000, picked["heavy"], 200)
+}
+
+func (s *ConnectionManagerTestSuite) TestRemoveSlave() {
+	manager := s.newIdleConnectionManager()
+	conn1 := &connection{host: "slave1", connected: 1}
+	conn2 := &connection{host: "slave2", connected: 1}
+	manager.addSlave(conn1)
+	manager.addSlave(conn2)
+	s.True(manager.hasSlave("slave1"))
+
+	manager.removeSlave(conn1)
+	s.False(manager.hasSlave("slave1"))
+	s.Equal([]*connection{conn2}, manager.getActiveSlaves())
+
+	manager.removeSlave(conn2)
+	s.Empty(manager.getActiveSlaves())
+}
@@ -1,11 +1,14 @@
 package hansip
 
 import (
+	"context"
 	"errors"
+	"runtime"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-pg/pg"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -25,7 +28,7 @@ func (s *ConnectionTestSuite) TestPingOK() {
 		pingTimeout:    1 * time.Second,
 		connCheckDelay: 100 * time.Millisecond,
 		s:              &dummySQL{},
-		pingFn: func() error {
+		pingFn: func(ctx context.Context) error {
 			return nil
 		},
 	}
@@ -39,7 +42,7 @@ func (s *ConnectionTestSuite) TestPingFail() {
 		pingTimeout:    1 * time.Second,
 		connCheckDelay: 100 * time.Millisecond,
 		s:              &dummySQL{},
-		pingFn: func() error {
+		pingFn: func(ctx context.Context) error {
 			return errors.New("something fails")
 		},
 	}
@@ -51,7 +54,7 @@ func (s *ConnectionTestSuite) TestPingTimeout() {
 		host:        "dummy",
 		quitChan:    make(chan struct{}),
 		pingTimeout: 100 * time.Millisecond,
-		pingFn: func() error {
+		pingFn: func(ctx context.Context) error {
 			time.Sleep(200 * time.Millisecond)
 			return errors.New("fail")
 		},
@@ -59,6 +62,87 @@ func (s *ConnectionTestSuite) TestPingTimeout() {
 	s.Equal(errPingTimeout, c.ping())
 }
 
+func (s *ConnectionTestSuite) TestPingTimeoutCancelsPing() {
+	c := &connection{
+		host:        "dummy",
+		quitChan:    make(chan struct{}),
+		pingTimeout: 100 * time.Millisecond,
+		pingFn: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+
+	start := time.Now()
+	s.Equal(errPingTimeout, c.ping())
+	s.True(time.Since(start) < 1*time.Second)
+}
+
+func (s *ConnectionTestSuite) TestPingDoesNotLeakGoroutines() {
+	c := &connection{
+		connected:   1,
+		host:        "dummy",
+		quitChan:    make(chan struct{}),
+		pingTimeout: 100 * time.Microsecond,
+		pingFn: func(ctx context.Context) error {
+			// hangs until ping gives up
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+
+	before := runtime.NumGoroutine()
+
+	// two hours worth of ticks with default ConnCheckDelay against a server that never answers
+	ticks := int(2 * time.Hour / defaultConnCheckDelay)
+	for i := 0; i < ticks; i++ {
+		c.updateStatus()
+	}
+	s.False(c.getConnected())
+
+	// give timers a moment to settle
+	time.Sleep(100 * time.Millisecond)
+	s.InDelta(before, runtime.NumGoroutine(), 2)
+}
+
+func (s *ConnectionTestSuite) TestPingIgnoringContext() {
+	stuck := make(chan struct{})
+	defer close(stuck)
+	var closed int32
+	c := &connection{
+		connected:      1,
+		host:           "dummy",
+		quitChan:       make(chan struct{}),
+		pingTimeout:    50 * time.Millisecond,
+		connCheckDelay: 10 * time.Millisecond,
+		pingFn: func(ctx context.Context) error {
+			<-stuck
+			return nil
+		},
+		closeFn: func() {
+			atomic.StoreInt32(&closed, 1)
+		},
+	}
+
+	s.Equal(errPingTimeout, c.ping())
+	// the stuck check is still running
+	s.Equal(errPingTimeout, c.ping())
+
+	go c.loop()
+	time.Sleep(100 * time.Millisecond)
+	quit := make(chan struct{})
+	go func() {
+		c.quit()
+		close(quit)
+	}()
+	select {
+	case <-quit:
+	case <-time.After(time.Second):
+		s.Fail("quit blocked on a stuck health check")
+	}
+	s.Equal(int32(1), atomic.LoadInt32(&closed))
+}
+
 func (s *ConnectionTestSuite) TestUpdateStatusWithPingOK() {
 	c := &connection{
 		host:           "dummy",
@@ -66,7 +150,7 @@ func (s *ConnectionTestSuite) TestUpdateStatusWithPingOK() {
 		pingTimeout:    1 * time.Second,
 		connCheckDelay: 100 * time.Millisecond,
 		s:              &dummySQL{},
-		pingFn: func() error {
+		pingFn: func(ctx context.Context) error {
 			return nil
 		},
 	}
@@ -82,7 +166,7 @@ func (s *ConnectionTestSuite) TestUpdateStatusWithPingError() {
 		pingTimeout:    1 * time.Second,
 		connCheckDelay: 100 * time.Millisecond,
 		s:              &dummySQL{},
-		pingFn: func() error {
+		pingFn: func(ctx context.Context) error {
 			return errors.New("something fails")
 		},
 	}
@@ -97,7 +181,7 @@ func (s *ConnectionTestSuite) TestConnected() {
 		pingTimeout:    1 * time.Second,
 		connCheckDelay: 100 * time.Millisecond,
 		s:              &dummySQL{},
-		pingFn: func() error {
+		pingFn: func(ctx context.Context) error {
 			return errors.New("something fails")
 		},
 	}
@@ -115,7 +199,7 @@ func (s *ConnectionTestSuite) TestQuit() {
 		pingTimeout:    1 * time.Second,
 		connCheckDelay: 100 * time.Millisecond,
 		s:              &dummySQL{},
-		pingFn: func() error {
+		pingFn: func(ctx context.Context) error {
 			return errors.New("fail")
 		},
 		closeFn: func() {
@@ -140,7 +224,7 @@ func (s *ConnectionTestSuite) TestLoopTriggersUpdateStatus() {
 		pingTimeout:    1 * time.Second,
 		connCheckDelay: 100 * time.Millisecond,
 		s:              &dummySQL{},
-		pingFn: func() error {
+		pingFn: func(ctx context.Context) error {
 			if atomic.LoadInt32(&pingErrFlag) == 0 {
 				return nil
 			}
@@ -157,3 +241,113 @@ func (s *ConnectionTestSuite) TestLoopTriggersUpdateStatus() {
 	time.Sleep(300 * time.Millisecond)
 	s.False(c.getConnected())
 }
+
+func (s *ConnectionTestSuite) TestUpdateStatusWithFailureThreshold() {
+	c := &connection{
+		connected:        1,
+		host:             "dummy",
+		quitChan:         make(chan struct{}),
+		pingTimeout:      1 * time.Second,
+		connCheckDelay:   100 * time.Millisecond,
+		failureThreshold: 3,
+		s:                &dummySQL{},
+		pingFn: func(ctx context.Context) error {
+			return errors.New("something fails")
+		},
+	}
+
+	c.updateStatus()
+	c.updateStatus()
+	s.True(c.getConnected())
+
+	c.updateStatus()
+	s.False(c.getConnected())
+}
+
+func (s *ConnectionTestSuite) TestUpdateStatusWithSuccessThreshold() {
+	var pingErrFlag int32
+
+	c := &connection{
+		host:             "dummy",
+		quitChan:         make(chan struct{}),
+		pingTimeout:      1 * time.Second,
+		connCheckDelay:   100 * time.Millisecond,
+		successThreshold: 2,
+		s:                &dummySQL{},
+		pingFn: func(ctx context.Context) error {
+			if atomic.LoadInt32(&pingErrFlag) == 0 {
+				return nil
+			}
+			return errors.New("something fails")
+		},
+	}
+
+	// a single lucky ping does not bring the node back
+	c.updateStatus()
+	s.False(c.getConnected())
+
+	// failure in between resets the count
+	atomic.StoreInt32(&pingErrFlag, 1)
+	c.updateStatus()
+	atomic.StoreInt32(&pingErrFlag, 0)
+	c.updateStatus()
+	s.False(c.getConnected())
+
+	c.updateStatus()
+	s.True(c.getConnected())
+}
+
+func (s *ConnectionTestSuite) TestNextCheckDelay() {
+	c := &connection{
+		host:            "dummy",
+		quitChan:        make(chan struct{}),
+		connCheckDelay:  100 * time.Millisecond,
+		maxCheckBackoff: 1 * time.Second,
+	}
+
+	// connected nodes are checked at normal pace
+	c.setConnected(true)
+	c.failures = 5
+	s.Equal(100*time.Millisecond, c.nextCheckDelay())
+
+	c.setConnected(false)
+	c.failures = 1
+	delay := c.nextCheckDelay()
+	s.True(delay >= 50*time.Millisecond && delay <= 100*time.Millisecond, delay)
+
+	c.failures = 3
+	delay = c.nextCheckDelay()
+	s.True(delay >= 200*time.Millisecond && delay <= 400*time.Millisecond, delay)
+
+	// capped at maxCheckBackoff
+	c.failures = 20
+	delay = c.nextCheckDelay()
+	s.True(delay >= 500*time.Millisecond && delay <= 1*time.Second, delay)
+
+	// no backoff when disabled
+	c.maxCheckBackoff = 0
+	s.Equal(100*time.Millisecond, c.nextCheckDelay())
+}
+
+func (s *ConnectionTestSuite) TestNewConnectionWithUnreachableNode() {
+	conf := &Config{
+		ConnPingTimeout: 1 * time.Second,
+		ConnCheckDelay:  100 * time.Millisecond,
+	}
+	conn, err := newConnection(&pg.Options{Addr: "127.0.0.1:1"}, conf, newNodeOptions(nil))
+	s.NotNil(err)
+	s.Nil(conn)
+}
+
+func (s *ConnectionTestSuite) TestNewConnectionWithLazyConnect() {
+	conf := &Config{
+		ConnPingTimeout: 1 * time.Second,
+		ConnCheckDelay:  100 * time.Millisecond,
+		LazyConnect:     true,
+	}
+	conn, err := newConnection(&pg.Options{Addr: "127.0.0.1:1"}, conf, newNodeOptions(nil))
+	s.Nil(err)
+	s.NotNil(conn)
+	s.False(conn.getConnected())
+	conn.quit()
+}
@@ -0,0 +1,108 @@
+package hansip
+
+import (
+	"context"
+	"io"
+
+	"github.com/go-pg/pg"
+)
+
+// CopyFrom streams r to master with a COPY ... FROM STDIN query and returns the number of copied rows.
+// Once ctx is done, or the statement timeout passed, the copy is cancelled on the server and no more
+// chunks are read from r. A Read of r which blocks is not interrupted.
+func (c *Cluster) CopyFrom(ctx context.Context, r io.Reader, query string, args ...interface{}) (int, error) {
+	if err := c.acquire(); err != nil {
+		return 0, err
+	}
+	defer c.release()
+
+	var rows int
+	err := onConnection(c.writer, func(conn *connection) error {
+		var err error
+		rows, err = conn.copyFrom(ctx, r, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// CopyTo streams rows of a COPY ... TO STDOUT query to w and returns the number of copied rows.
+// It runs on a reader picked like QueryContext and is cancelled like CopyFrom,
+// a Write to w which blocks is not interrupted.
+func (c *Cluster) CopyTo(ctx context.Context, w io.Writer, query string, args ...interface{}) (int, error) {
+	if err := c.acquire(); err != nil {
+		return 0, err
+	}
+	defer c.release()
+
+	var rows int
+	err := onConnection(func() (*connection, error) {
+		return c.reader(ctx)
+	}, func(conn *connection) error {
+		var err error
+		rows, err = conn.copyTo(ctx, w, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// contextReader fails reads once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// contextWriter fails writes once ctx is done.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// copyCancellable runs fn on a pinned connection whose query is cancelled on the server once ctx is done,
+// go-pg copies do not take ctx. It costs a round trip to learn the backend of the connection.
+func copyCancellable(ctx context.Context, db *pg.DB, q gopgQuerier, fn func(q gopgQuerier) (pg.Result, error)) (pg.Result, error) {
+	if pool, ok := q.(*pg.DB); ok {
+		conn := pool.Conn()
+		defer conn.Close()
+		q = conn
+	}
+	var pid int
+	if _, err := q.QueryContext(ctx, pg.Scan(&pid), "select pg_backend_pid();"); err != nil {
+		return nil, err
+	}
+	stop := cancelOnDone(ctx, db, pid)
+	defer stop()
+	return fn(q)
+}
+
+// cancelOnDone cancels the running query of backend pid once ctx is done.
+// stop waits for a cancel in progress, so it does not hit later queries of the connection.
+func cancelOnDone(ctx context.Context, db *pg.DB, pid int) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			db.Exec("select pg_cancel_backend(?);", pid)
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
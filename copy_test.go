@@ -0,0 +1,141 @@
+package hansip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/stretchr/testify/suite"
+)
+
+type CopyTestSuite struct {
+	TestSuite
+}
+
+func TestCopy(t *testing.T) {
+	s := &CopyTestSuite{}
+	s.noCreateCluster = true
+	suite.Run(t, s)
+}
+
+func (s *CopyTestSuite) TestRouting() {
+	slave := &dummySQL{}
+	cluster, master := newDummyCluster(&Config{}, &connection{connected: 1, s: slave})
+
+	rows, err := cluster.CopyFrom(context.Background(), strings.NewReader("1\ta\n2\tb\n"), "copy users from stdin;")
+	s.Nil(err)
+	s.Equal(2, rows)
+	s.True(master.copyRun)
+	s.False(slave.copyRun)
+
+	master.copyRun = false
+	var out bytes.Buffer
+	rows, err = cluster.CopyTo(context.Background(), &out, "copy users to stdout;")
+	s.Nil(err)
+	s.Equal(1, rows)
+	s.Equal("1\n", out.String())
+	s.True(slave.copyRun)
+	s.False(master.copyRun)
+
+	tx, err := cluster.NewTransaction()
+	s.Nil(err)
+	copier, ok := tx.(CopyTransaction)
+	s.True(ok)
+	rows, err = copier.CopyFrom(strings.NewReader("1\n"), "copy users from stdin;")
+	s.Nil(err)
+	s.Equal(1, rows)
+	s.Nil(tx.Rollback())
+
+	cluster.manager.master = nil
+	_, err = cluster.CopyFrom(context.Background(), strings.NewReader(""), "copy users from stdin;")
+	s.Equal(ErrNoMasterAvailable, err)
+}
+
+func (s *CopyTestSuite) TestWrapsErrors() {
+	pgErr := &fakePGError{code: "42P01", message: "relation \"users\" does not exist"}
+	conn := &connection{host: "db1:5432", role: RoleMaster, s: &failingSQL{err: pgErr}}
+
+	_, err := conn.copyFrom(context.Background(), strings.NewReader(""), "copy users from stdin;")
+	var hansipErr *Error
+	s.True(errors.As(err, &hansipErr))
+	s.Equal("copy from", hansipErr.Op)
+
+	_, err = conn.copyTo(context.Background(), &bytes.Buffer{}, "copy users to stdout;")
+	s.True(errors.As(err, &hansipErr))
+	s.Equal("copy to", hansipErr.Op)
+}
+
+func (s *CopyTestSuite) TestContextReaderAndWriter() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &contextReader{ctx: ctx, r: strings.NewReader("1\n2\n")}
+	w := &contextWriter{ctx: ctx, w: &bytes.Buffer{}}
+
+	buf := make([]byte, 2)
+	n, err := r.Read(buf)
+	s.Nil(err)
+	s.Equal(2, n)
+	_, err = w.Write(buf)
+	s.Nil(err)
+
+	cancel()
+	_, err = r.Read(buf)
+	s.Equal(context.Canceled, err)
+	_, err = w.Write(buf)
+	s.Equal(context.Canceled, err)
+}
+
+func (s *CopyTestSuite) TestCopy() {
+	cluster := NewCluster(&Config{})
+	defer cluster.Shutdown(context.Background())
+	s.Nil(cluster.SetMaster(s.getMasterConnectionInfo()))
+
+	s.Nil(cluster.WriterExec("drop table if exists hansip_copy;"))
+	s.Nil(cluster.WriterExec("create table hansip_copy (id int, name text);"))
+	defer cluster.WriterExec("drop table hansip_copy;")
+
+	rows, err := cluster.CopyFrom(context.Background(), strings.NewReader("1\ta\n2\tb\n"), "copy hansip_copy from stdin;")
+	s.Nil(err)
+	s.Equal(2, rows)
+
+	var out bytes.Buffer
+	rows, err = cluster.CopyTo(context.Background(), &out, "copy (select * from hansip_copy order by id) to stdout;")
+	s.Nil(err)
+	s.Equal(2, rows)
+	s.Equal("1\ta\n2\tb\n", out.String())
+
+	tx, err := cluster.NewTransaction()
+	s.Nil(err)
+	copier, ok := tx.(CopyTransaction)
+	s.True(ok)
+	rows, err = copier.CopyFrom(strings.NewReader("3\tc\n"), "copy hansip_copy from stdin;")
+	s.Nil(err)
+	s.Equal(1, rows)
+	out.Reset()
+	rows, err = copier.CopyTo(&out, "copy (select * from hansip_copy where id = ?) to stdout;", 3)
+	s.Nil(err)
+	s.Equal(1, rows)
+	s.Equal("3\tc\n", out.String())
+	s.Nil(tx.Rollback())
+
+	// a cancelled copy fails without breaking later queries
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cluster.CopyFrom(ctx, strings.NewReader("4\td\n"), "copy hansip_copy from stdin;")
+	s.NotNil(err)
+
+	var count int
+	s.Nil(cluster.WriterQuery(pg.Scan(&count), "select count(*) from hansip_copy;"))
+	s.Equal(2, count)
+
+	// a copy running on the server is cancelled by the statement timeout
+	ctx = WithStatementTimeout(context.Background(), 100*time.Millisecond)
+	started := time.Now()
+	_, err = cluster.CopyTo(ctx, &out, "copy (select pg_sleep(10)) to stdout;")
+	var timeoutErr *StatementTimeoutError
+	s.True(errors.As(err, &timeoutErr))
+	s.True(time.Since(started) < 5*time.Second)
+}
@@ -0,0 +1,162 @@
+package hansip
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// Credentials authenticate new connections to a node.
+type Credentials struct {
+	// User replaces user of pg.Options when it is not empty, for example with dynamic database users.
+	User     string
+	Password string
+	// ExpiresAt is when the credentials stop working, zero for credentials without expiry.
+	ExpiresAt time.Time
+}
+
+// CredentialProvider returns credentials used to open new connections to a node,
+// for example a cloud IAM auth token or a password managed by vault.
+// addr and user come from pg.Options of the node.
+type CredentialProvider interface {
+	Credentials(ctx context.Context, addr, user string) (*Credentials, error)
+}
+
+// CredentialProviderFunc adapts a function to CredentialProvider.
+type CredentialProviderFunc func(ctx context.Context, addr, user string) (*Credentials, error)
+
+// Credentials calls f.
+func (f CredentialProviderFunc) Credentials(ctx context.Context, addr, user string) (*Credentials, error) {
+	return f(ctx, addr, user)
+}
+
+// CredentialCache caches credentials of another provider per node.
+// Credentials are fetched again refreshBefore ahead of their expiry,
+// credentials without expiry are kept until a node fails to authenticate with them.
+type CredentialCache struct {
+	provider      CredentialProvider
+	refreshBefore time.Duration
+	now           func() time.Time
+
+	mutex   sync.Mutex
+	entries map[string]*Credentials
+}
+
+// NewCredentialCache creates CredentialCache on top of provider.
+func NewCredentialCache(provider CredentialProvider, refreshBefore time.Duration) *CredentialCache {
+	return &CredentialCache{
+		provider:      provider,
+		refreshBefore: refreshBefore,
+		now:           time.Now,
+		entries:       map[string]*Credentials{},
+	}
+}
+
+// Credentials returns cached credentials of the node or fetches new ones.
+func (c *CredentialCache) Credentials(ctx context.Context, addr, user string) (*Credentials, error) {
+	key := addr + "/" + user
+
+	c.mutex.Lock()
+	creds, ok := c.entries[key]
+	c.mutex.Unlock()
+	if ok && (creds.ExpiresAt.IsZero() || c.now().Add(c.refreshBefore).Before(creds.ExpiresAt)) {
+		return creds, nil
+	}
+
+	creds, err := c.provider.Credentials(ctx, addr, user)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.entries[key] = creds
+	c.mutex.Unlock()
+	return creds, nil
+}
+
+// Invalidate drops cached credentials of the node, they are fetched again on next call.
+func (c *CredentialCache) Invalidate(addr, user string) {
+	c.mutex.Lock()
+	delete(c.entries, addr+"/"+user)
+	c.mutex.Unlock()
+}
+
+// credentialError is returned when credentials can not be fetched from the provider.
+type credentialError struct {
+	err error
+}
+
+func (e *credentialError) Error() string {
+	return fmt.Sprintf("fetching credentials: %v", e.err)
+}
+
+// Unwrap returns the error of the provider.
+func (e *credentialError) Unwrap() error {
+	return e.err
+}
+
+// nodeCredentials keeps credentials of a node fresh.
+// go-pg reads the password from pg.Options while opening a connection,
+// so the pool of the node is rebuilt whenever its credentials change.
+// Credentials are refreshed before the pool is handed out, connections opened by it use them already.
+type nodeCredentials struct {
+	provider CredentialProvider
+	options  *pg.Options
+	s        *gopgSQL
+
+	mutex    sync.Mutex
+	user     string
+	password string
+	closed   bool
+}
+
+func newNodeCredentials(provider CredentialProvider, options *pg.Options, s *gopgSQL) *nodeCredentials {
+	n := &nodeCredentials{
+		provider: provider,
+		options:  options,
+		s:        s,
+	}
+	s.refresh = n.refresh
+	return n
+}
+
+// refresh fetches credentials and rebuilds the pool when they differ from credentials in use.
+func (n *nodeCredentials) refresh(ctx context.Context) error {
+	creds, err := n.provider.Credentials(ctx, n.options.Addr, n.options.User)
+	if err != nil {
+		return &credentialError{err: err}
+	}
+	user := creds.User
+	if user == "" {
+		user = n.options.User
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed || (n.s.getDB() != nil && user == n.user && creds.Password == n.password) {
+		return nil
+	}
+	n.user, n.password = user, creds.Password
+
+	opts := *n.options
+	opts.User, opts.Password = user, creds.Password
+	// the previous pool is closed once statements and transactions running on it are done
+	n.s.replaceDB(pg.Connect(&opts))
+	return nil
+}
+
+// invalidate drops credentials cached by the provider after the node rejected them.
+func (n *nodeCredentials) invalidate() {
+	if cache, ok := n.provider.(interface{ Invalidate(addr, user string) }); ok {
+		cache.Invalidate(n.options.Addr, n.options.User)
+	}
+}
+
+func (n *nodeCredentials) close() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.closed = true
+	n.s.close()
+}
@@ -0,0 +1,138 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/stretchr/testify/suite"
+)
+
+type CredentialsTestSuite struct {
+	suite.Suite
+}
+
+func TestCredentials(t *testing.T) {
+	s := &CredentialsTestSuite{}
+	suite.Run(t, s)
+}
+
+func (s *CredentialsTestSuite) TestCacheRefreshesBeforeExpiry() {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	calls := 0
+	cache := NewCredentialCache(CredentialProviderFunc(func(ctx context.Context, addr, user string) (*Credentials, error) {
+		calls++
+		return &Credentials{
+			Password:  "token",
+			ExpiresAt: now.Add(15 * time.Minute),
+		}, nil
+	}), 5*time.Minute)
+	cache.now = func() time.Time { return now }
+
+	_, err := cache.Credentials(context.Background(), "db:5432", "app")
+	s.Nil(err)
+	now = now.Add(9 * time.Minute)
+	_, err = cache.Credentials(context.Background(), "db:5432", "app")
+	s.Nil(err)
+	s.Equal(1, calls)
+
+	// within refreshBefore of the expiry
+	now = now.Add(2 * time.Minute)
+	_, err = cache.Credentials(context.Background(), "db:5432", "app")
+	s.Nil(err)
+	s.Equal(2, calls)
+
+	// other nodes are cached separately
+	_, err = cache.Credentials(context.Background(), "replica:5432", "app")
+	s.Nil(err)
+	s.Equal(3, calls)
+}
+
+func (s *CredentialsTestSuite) TestCacheInvalidate() {
+	calls := 0
+	cache := NewCredentialCache(CredentialProviderFunc(func(ctx context.Context, addr, user string) (*Credentials, error) {
+		calls++
+		return &Credentials{Password: "secret"}, nil
+	}), time.Minute)
+
+	cache.Credentials(context.Background(), "db:5432", "app")
+	cache.Credentials(context.Background(), "db:5432", "app")
+	s.Equal(1, calls)
+
+	cache.Invalidate("db:5432", "app")
+	cache.Credentials(context.Background(), "db:5432", "app")
+	s.Equal(2, calls)
+}
+
+func (s *CredentialsTestSuite) TestRefreshRebuildsPool() {
+	password := "first"
+	provider := CredentialProviderFunc(func(ctx context.Context, addr, user string) (*Credentials, error) {
+		return &Credentials{Password: password}, nil
+	})
+	sql := &gopgSQL{}
+	creds := newNodeCredentials(provider, &pg.Options{Addr: "127.0.0.1:1", User: "app"}, sql)
+	defer creds.close()
+
+	s.Nil(creds.refresh(context.Background()))
+	db := sql.getDB()
+	s.Equal("app", db.Options().User)
+	s.Equal("first", db.Options().Password)
+
+	// same credentials keep the pool
+	s.Nil(creds.refresh(context.Background()))
+	s.True(db == sql.getDB())
+
+	password = "second"
+	s.Nil(creds.refresh(context.Background()))
+	s.False(db == sql.getDB())
+	s.Equal("second", sql.getDB().Options().Password)
+}
+
+func (s *CredentialsTestSuite) TestRetiredPoolClosedWhenUnused() {
+	password := "first"
+	provider := CredentialProviderFunc(func(ctx context.Context, addr, user string) (*Credentials, error) {
+		return &Credentials{Password: password}, nil
+	})
+	sql := &gopgSQL{}
+	creds := newNodeCredentials(provider, &pg.Options{Addr: "127.0.0.1:1", User: "app"}, sql)
+	defer creds.close()
+
+	first, release, err := sql.acquire(context.Background())
+	s.Nil(err)
+	s.Equal("first", first.Options().Password)
+
+	// new credentials are used by the pool handed out next, the pool in use stays open
+	password = "second"
+	second, releaseSecond, err := sql.acquire(context.Background())
+	s.Nil(err)
+	s.Equal("second", second.Options().Password)
+	releaseSecond()
+	s.True(sql.retired[first])
+
+	release()
+	s.False(sql.retired[first])
+	s.NotNil(first.Close(), "retired pool is closed already")
+	s.Nil(second.Close())
+}
+
+func (s *CredentialsTestSuite) TestHealthReportsAuthFailure() {
+	cluster := NewCluster(&Config{
+		LazyConnect: true,
+		CredentialProvider: CredentialProviderFunc(func(ctx context.Context, addr, user string) (*Credentials, error) {
+			return nil, errors.New("token expired")
+		}),
+	})
+	defer cluster.Shutdown(context.Background())
+
+	s.Nil(cluster.SetMaster(&pg.Options{Addr: "127.0.0.1:1"}))
+	health := cluster.Health()
+	s.Len(health, 1)
+	s.Equal("127.0.0.1:1", health[0].Host)
+	s.True(health[0].Master)
+	s.Equal(NodeAuthFailed, health[0].State)
+	s.EqualError(health[0].LastError, "fetching credentials: token expired")
+
+	s.Equal(ErrNoMasterAvailable, cluster.WriterExec("select 1;"))
+}
@@ -0,0 +1,106 @@
+package hansip
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// Topology is the set of nodes a cluster should be connected to.
+type Topology struct {
+	// Master is left untouched when nil.
+	Master *pg.Options
+	Slaves []*pg.Options
+}
+
+// sameAddrs tells whether both topologies point to the same addresses.
+func (t Topology) sameAddrs(other Topology) bool {
+	return t.key() == other.key()
+}
+
+func (t Topology) key() string {
+	var master string
+	if t.Master != nil {
+		master = t.Master.Addr
+	}
+	slaves := make([]string, 0, len(t.Slaves))
+	for _, opts := range t.Slaves {
+		slaves = append(slaves, opts.Addr)
+	}
+	sort.Strings(slaves)
+	return master + "|" + strings.Join(slaves, ",")
+}
+
+// Discoverer watches a registry such as Patroni, Consul or etcd for topology changes.
+type Discoverer interface {
+	// Watch sends current topology and every change of it until ctx is done, then closes the channel.
+	Watch(ctx context.Context) <-chan Topology
+}
+
+// Discover reconciles cluster connections against every topology sent by d.
+// Master is replaced when its address changes. Slaves are added and removed to match the topology,
+// slaves added with AddSlave are left untouched.
+// The last topology is applied again every interval, 30 seconds when not positive,
+// so nodes which failed to connect are retried even when the topology does not change.
+// Errors of applying a topology are passed to onError when it is not nil.
+// Discovery stops when ctx is done or the cluster is shut down.
+func (c *Cluster) Discover(ctx context.Context, d Discoverer, interval time.Duration, onError func(error)) {
+	ctx, cancel := context.WithCancel(ctx)
+	topologies := d.Watch(ctx)
+	slaves := newSlaveSet(c)
+	report := func(err error) {
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+
+	go func() {
+		defer cancel()
+		ticker := time.NewTicker(pollInterval(interval))
+		defer ticker.Stop()
+
+		var last *Topology
+		for {
+			select {
+			case topology, ok := <-topologies:
+				if !ok {
+					return
+				}
+				last = &topology
+				report(c.applyTopology(slaves, topology))
+			case <-ticker.C:
+				if last != nil {
+					report(c.applyTopology(slaves, *last))
+				}
+			case <-c.quitChan:
+				return
+			}
+		}
+	}()
+}
+
+// applyTopology makes master and slaves owned by given slaveSet match topology.
+// Nodes which fail to connect are retried on next apply, the first error is returned.
+func (c *Cluster) applyTopology(slaves *slaveSet, topology Topology) error {
+	var firstErr error
+	if topology.Master != nil {
+		if master := c.manager.getMaster(); master == nil || master.host != topology.Master.Addr {
+			if err := c.SetMaster(topology.Master); err != nil {
+				firstErr = fmt.Errorf("master %s: %w", topology.Master.Addr, err)
+			}
+		}
+	}
+
+	desired := make(map[string]*nodeSpec, len(topology.Slaves))
+	for _, opts := range topology.Slaves {
+		desired[opts.Addr] = &nodeSpec{options: opts}
+	}
+	if err := slaves.reconcile(desired); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
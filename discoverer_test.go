@@ -0,0 +1,247 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/stretchr/testify/suite"
+)
+
+type DiscovererTestSuite struct {
+	suite.Suite
+}
+
+func TestDiscoverer(t *testing.T) {
+	s := &DiscovererTestSuite{}
+	suite.Run(t, s)
+}
+
+func (s *DiscovererTestSuite) receive(topologies <-chan Topology) Topology {
+	select {
+	case topology := <-topologies:
+		return topology
+	case <-time.After(1 * time.Second):
+		s.FailNow("no topology received")
+		return Topology{}
+	}
+}
+
+func (s *DiscovererTestSuite) addrs(opts []*pg.Options) []string {
+	addrs := make([]string, 0, len(opts))
+	for _, o := range opts {
+		addrs = append(addrs, o.Addr)
+	}
+	return addrs
+}
+
+// chanDiscoverer sends whatever is written to its channel
+type chanDiscoverer chan Topology
+
+func (d chanDiscoverer) Watch(ctx context.Context) <-chan Topology {
+	return d
+}
+
+func (s *DiscovererTestSuite) TestClusterDiscover() {
+	cluster := NewCluster(&Config{
+		ConnCheckDelay: 1 * time.Hour,
+		HealthCheck: func(ctx context.Context, node *Node) error {
+			return nil
+		},
+	})
+	defer cluster.Shutdown(context.Background())
+
+	d := make(chanDiscoverer)
+	cluster.Discover(context.Background(), d, 1*time.Hour, nil)
+
+	// topologies are sent twice, second send waits for the first one to be applied
+	initial := Topology{
+		Master: &pg.Options{Addr: "pg-0:5432"},
+		Slaves: []*pg.Options{{Addr: "pg-1:5432"}, {Addr: "pg-2:5432"}},
+	}
+	d <- initial
+	d <- initial
+	s.Equal("pg-0:5432", cluster.manager.getMaster().host)
+	s.Len(cluster.manager.getActiveSlaves(), 2)
+
+	// failover, pg-1 is promoted and pg-2 is gone
+	failover := Topology{
+		Master: &pg.Options{Addr: "pg-1:5432"},
+		Slaves: []*pg.Options{{Addr: "pg-0:5432"}},
+	}
+	d <- failover
+	d <- failover
+	s.Equal("pg-1:5432", cluster.manager.getMaster().host)
+	s.Len(cluster.manager.getActiveSlaves(), 1)
+	s.Equal("pg-0:5432", cluster.manager.getActiveSlaves()[0].host)
+	s.NotNil(cluster.manager.writer())
+}
+
+func (s *DiscovererTestSuite) TestClusterDiscoverRetries() {
+	var down int32 = 1
+	cluster := NewCluster(&Config{
+		ConnCheckDelay: 1 * time.Hour,
+		HealthCheck: func(ctx context.Context, node *Node) error {
+			if node.Host == "pg-2:5432" && atomic.LoadInt32(&down) == 1 {
+				return errors.New("connection refused")
+			}
+			return nil
+		},
+	})
+	defer cluster.Shutdown(context.Background())
+
+	errs := make(chan error, 1)
+	d := make(chanDiscoverer)
+	cluster.Discover(context.Background(), d, 50*time.Millisecond, func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	d <- Topology{
+		Master: &pg.Options{Addr: "pg-0:5432"},
+		Slaves: []*pg.Options{{Addr: "pg-1:5432"}, {Addr: "pg-2:5432"}},
+	}
+
+	select {
+	case err := <-errs:
+		s.Contains(err.Error(), "pg-2:5432")
+	case <-time.After(time.Second):
+		s.FailNow("error was not reported")
+	}
+
+	// pg-2 is retried without a new topology being sent
+	atomic.StoreInt32(&down, 0)
+	deadline := time.Now().Add(time.Second)
+	for len(cluster.manager.getActiveSlaves()) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Len(cluster.manager.getActiveSlaves(), 2)
+}
+
+func (s *DiscovererTestSuite) TestPatroniDiscoverer() {
+	var mutex sync.Mutex
+	leader := "10.0.0.1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Equal("/cluster", r.URL.Path)
+		mutex.Lock()
+		defer mutex.Unlock()
+		replica := "10.0.0.2"
+		if leader == replica {
+			replica = "10.0.0.1"
+		}
+		fmt.Fprintf(w, `{"members": [
+			{"name": "pg-0", "role": "leader", "state": "running", "host": %q, "port": 5432},
+			{"name": "pg-1", "role": "replica", "state": "streaming", "host": %q, "port": 5432, "lag": 0},
+			{"name": "pg-2", "role": "replica", "state": "streaming", "host": "10.0.0.3", "port": 5433, "lag": 104857600},
+			{"name": "pg-3", "role": "replica", "state": "starting", "host": "10.0.0.4", "port": 5432, "lag": "unknown"}
+		]}`, leader, replica)
+	}))
+	defer server.Close()
+
+	d := &PatroniDiscoverer{
+		URL:      server.URL,
+		Options:  &pg.Options{User: "app", Database: "db"},
+		Interval: 50 * time.Millisecond,
+		MaxLag:   1024 * 1024,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	topologies := d.Watch(ctx)
+
+	topology := s.receive(topologies)
+	s.Equal("10.0.0.1:5432", topology.Master.Addr)
+	s.Equal("app", topology.Master.User)
+	s.Equal([]string{"10.0.0.2:5432"}, s.addrs(topology.Slaves))
+
+	// unchanged topology is not sent again
+	select {
+	case <-topologies:
+		s.Fail("unchanged topology is sent")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	mutex.Lock()
+	leader = "10.0.0.2"
+	mutex.Unlock()
+	topology = s.receive(topologies)
+	s.Equal("10.0.0.2:5432", topology.Master.Addr)
+	s.Equal([]string{"10.0.0.1:5432"}, s.addrs(topology.Slaves))
+
+	cancel()
+	_, ok := <-topologies
+	s.False(ok)
+}
+
+func (s *DiscovererTestSuite) TestPatroniStandbyCluster() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"members": [
+			{"name": "pg-0", "role": "standby_leader", "state": "running", "host": "10.0.0.1", "port": 5432},
+			{"name": "pg-1", "role": "replica", "state": "streaming", "host": "10.0.0.2", "port": 5432, "lag": 0}
+		]}`)
+	}))
+	defer server.Close()
+
+	d := &PatroniDiscoverer{URL: server.URL}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	topology := s.receive(d.Watch(ctx))
+	s.Nil(topology.Master)
+	s.Equal([]string{"10.0.0.1:5432", "10.0.0.2:5432"}, s.addrs(topology.Slaves))
+}
+
+func (s *DiscovererTestSuite) TestFileDiscoverer() {
+	dir, err := ioutil.TempDir("", "hansip")
+	s.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "topology.yaml")
+	s.Nil(ioutil.WriteFile(path, []byte(`
+master:
+  url: postgres://app@pg-0:5432/db
+slaves:
+  - url: postgres://app@pg-1:5432/db
+`), 0600))
+
+	d := &FileDiscoverer{
+		Path:     path,
+		Interval: 50 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	topologies := d.Watch(ctx)
+
+	topology := s.receive(topologies)
+	s.Equal("pg-0:5432", topology.Master.Addr)
+	s.Equal([]string{"pg-1:5432"}, s.addrs(topology.Slaves))
+
+	// invalid content is skipped
+	s.Nil(ioutil.WriteFile(path, []byte(`master: {}`), 0600))
+	select {
+	case <-topologies:
+		s.Fail("invalid topology is sent")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	s.Nil(ioutil.WriteFile(path, []byte(`
+master:
+  url: postgres://app@pg-1:5432/db
+slaves:
+  - url: postgres://app@pg-0:5432/db
+  - url: postgres://app@pg-2:5432/db
+`), 0600))
+	topology = s.receive(topologies)
+	s.Equal("pg-1:5432", topology.Master.Addr)
+	s.Equal([]string{"pg-0:5432", "pg-2:5432"}, s.addrs(topology.Slaves))
+}
@@ -0,0 +1,232 @@
+package hansip
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+const replicationQuery = `
+select
+	coalesce(host(client_addr), '') as client_addr,
+	application_name,
+	state,
+	coalesce(extract(epoch from replay_lag), 0)::float8 as replay_lag_seconds
+from pg_stat_replication;`
+
+// defaultPollInterval is used by discovery and config watching when no positive interval is given.
+const defaultPollInterval = 30 * time.Second
+
+func pollInterval(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return defaultPollInterval
+	}
+	return interval
+}
+
+// Replica describes a streaming replica listed in pg_stat_replication of master.
+type Replica struct {
+	ClientAddr      string
+	ApplicationName string
+	State           string
+	ReplayLag       time.Duration
+}
+
+// ReplicaResolver maps a replica to options used to connect to it.
+// Returning nil options without error skips the replica.
+type ReplicaResolver func(replica *Replica) (*pg.Options, error)
+
+// StartReplicationDiscovery reads pg_stat_replication on master every interval, 30 seconds when not positive.
+// Streaming replicas are resolved to connection options and added as slaves,
+// slaves added by previous rounds are removed once their replica is no longer streaming.
+// A replica which fails to resolve keeps options it was last resolved to, the other replicas are still reconciled.
+// Slaves added with AddSlave are left untouched.
+// Errors of every round are passed to onError when it is not nil.
+// Discovery stops when ctx is done or the cluster is shut down.
+func (c *Cluster) StartReplicationDiscovery(ctx context.Context, resolver ReplicaResolver, interval time.Duration, onError func(error)) {
+	d := &replicationDiscovery{
+		cluster:  c,
+		resolver: resolver,
+		interval: pollInterval(interval),
+		onError:  onError,
+		slaves:   newSlaveSet(c),
+		resolved: map[string]*pg.Options{},
+	}
+	d.listFn = d.listReplicas
+	go d.loop(ctx)
+}
+
+type replicationDiscovery struct {
+	cluster  *Cluster
+	resolver ReplicaResolver
+	interval time.Duration
+	onError  func(error)
+
+	listFn func(ctx context.Context) ([]*Replica, error)
+	slaves *slaveSet
+	// options replicas were last resolved to, by replicaKey
+	resolved map[string]*pg.Options
+}
+
+func (d *replicationDiscovery) loop(ctx context.Context) {
+	d.report(d.discover(ctx))
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.report(d.discover(ctx))
+		case <-ctx.Done():
+			return
+		case <-d.cluster.quitChan:
+			return
+		}
+	}
+}
+
+func (d *replicationDiscovery) report(err error) {
+	if err != nil && d.onError != nil {
+		d.onError(err)
+	}
+}
+
+// discover runs one round of discovery, when listing fails current slaves are kept and it is retried next round.
+// Listing is bounded by the interval, so a master which does not answer does not block later rounds.
+// The first error of resolving replicas or connecting to them is returned.
+func (d *replicationDiscovery) discover(ctx context.Context) error {
+	listCtx, cancel := context.WithTimeout(ctx, d.interval)
+	replicas, err := d.listFn(listCtx)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	desired := map[string]*nodeSpec{}
+	resolved := make(map[string]*pg.Options, len(replicas))
+	for _, replica := range replicas {
+		if replica.State != "streaming" {
+			continue
+		}
+		key := replica.ClientAddr + "/" + replica.ApplicationName
+		opts, err := d.resolver(replica)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", replica.ApplicationName, err)
+			}
+			opts = d.resolved[key]
+		}
+		if opts != nil {
+			resolved[key] = opts
+			desired[opts.Addr] = &nodeSpec{options: opts}
+		}
+	}
+	d.resolved = resolved
+
+	if err := d.slaves.reconcile(desired); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func (d *replicationDiscovery) listReplicas(ctx context.Context) ([]*Replica, error) {
+	var rows []struct {
+		ClientAddr       string
+		ApplicationName  string
+		State            string
+		ReplayLagSeconds float64
+	}
+	err := onConnection(d.cluster.writer, func(conn *connection) error {
+		return conn.query(ctx, &rows, replicationQuery)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	replicas := make([]*Replica, 0, len(rows))
+	for _, row := range rows {
+		replicas = append(replicas, &Replica{
+			ClientAddr:      row.ClientAddr,
+			ApplicationName: row.ApplicationName,
+			State:           row.State,
+			ReplayLag:       time.Duration(row.ReplayLagSeconds * float64(time.Second)),
+		})
+	}
+	return replicas, nil
+}
+
+// nodeSpec describes how to connect to a node.
+type nodeSpec struct {
+	options  *pg.Options
+	nodeOpts []NodeOption
+}
+
+// slaveSet tracks slaves added by one discovery source,
+// so the source only adds and removes slaves it owns.
+type slaveSet struct {
+	cluster *Cluster
+	conns   map[string]*connection
+	// options conns were created with, by key
+	opts map[string]*nodeOptions
+}
+
+func newSlaveSet(cluster *Cluster) *slaveSet {
+	return &slaveSet{
+		cluster: cluster,
+		conns:   map[string]*connection{},
+		opts:    map[string]*nodeOptions{},
+	}
+}
+
+// reconcile connects to desired nodes which are not slaves yet and removes owned slaves which are not desired.
+// Nodes are identified by keys of desired, weight of nodes which are already connected is updated.
+// Other node options are fixed once a node connects, a node whose options changed is connected again
+// and replaces its previous connection.
+// Nodes which fail to connect are retried on next reconcile, the first error is returned.
+func (s *slaveSet) reconcile(desired map[string]*nodeSpec) error {
+	if err := s.cluster.acquire(); err != nil {
+		return err
+	}
+	defer s.cluster.release()
+
+	for key, conn := range s.conns {
+		if _, ok := desired[key]; !ok {
+			s.cluster.manager.removeSlave(conn)
+			s.cluster.manager.retire(conn)
+			delete(s.conns, key)
+			delete(s.opts, key)
+		}
+	}
+
+	var firstErr error
+	for key, spec := range desired {
+		nodeOpts := newNodeOptions(spec.nodeOpts)
+		previous, owned := s.conns[key]
+		if owned && s.opts[key].sameNode(nodeOpts) {
+			previous.setWeight(nodeOpts.weight)
+			continue
+		}
+		if !owned && s.cluster.manager.hasSlave(spec.options.Addr) {
+			continue
+		}
+
+		conn, err := newConnection(spec.options, s.cluster.getConfig(), nodeOpts)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", spec.options.Addr, err)
+			}
+			continue
+		}
+		if owned {
+			s.cluster.manager.removeSlave(previous)
+			s.cluster.manager.retire(previous)
+		}
+		s.conns[key] = conn
+		s.opts[key] = nodeOpts
+		s.cluster.manager.addSlave(conn)
+	}
+	return firstErr
+}
@@ -0,0 +1,267 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/stretchr/testify/suite"
+)
+
+type DiscoveryTestSuite struct {
+	suite.Suite
+	cluster *Cluster
+}
+
+func TestDiscovery(t *testing.T) {
+	s := &DiscoveryTestSuite{}
+	suite.Run(t, s)
+}
+
+func (s *DiscoveryTestSuite) SetupTest() {
+	s.cluster = NewCluster(&Config{
+		ConnCheckDelay: 1 * time.Hour,
+		HealthCheck: func(ctx context.Context, node *Node) error {
+			return nil
+		},
+	})
+}
+
+func (s *DiscoveryTestSuite) TearDownTest() {
+	s.Nil(s.cluster.Shutdown(context.Background()))
+}
+
+func (s *DiscoveryTestSuite) slaveHosts() []string {
+	var hosts []string
+	for _, conn := range s.cluster.manager.getSlaves() {
+		hosts = append(hosts, conn.host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func (s *DiscoveryTestSuite) newReplicationDiscovery(replicas *[]*Replica) *replicationDiscovery {
+	return &replicationDiscovery{
+		cluster:  s.cluster,
+		interval: 1 * time.Hour,
+		slaves:   newSlaveSet(s.cluster),
+		resolved: map[string]*pg.Options{},
+		resolver: func(replica *Replica) (*pg.Options, error) {
+			if replica.ReplayLag > 1*time.Minute {
+				return nil, nil
+			}
+			return &pg.Options{Addr: replica.ClientAddr + ":5432"}, nil
+		},
+		listFn: func(ctx context.Context) ([]*Replica, error) {
+			return *replicas, nil
+		},
+	}
+}
+
+func (s *DiscoveryTestSuite) TestListReplicasIsBounded() {
+	cluster, master := newDummyCluster(&Config{})
+	master.block = make(chan struct{})
+	defer close(master.block)
+	d := &replicationDiscovery{cluster: cluster, interval: 50 * time.Millisecond}
+	d.listFn = d.listReplicas
+
+	started := time.Now()
+	s.True(errors.Is(d.discover(context.Background()), context.DeadlineExceeded))
+	s.True(time.Since(started) < time.Second)
+}
+
+func (s *DiscoveryTestSuite) TestReplicationDiscovery() {
+	s.Nil(s.cluster.AddSlave(&pg.Options{Addr: "static:5432"}))
+
+	replicas := []*Replica{
+		{ClientAddr: "10.0.0.1", ApplicationName: "replica1", State: "streaming"},
+		{ClientAddr: "10.0.0.2", ApplicationName: "replica2", State: "catchup"},
+		{ClientAddr: "10.0.0.3", ApplicationName: "replica3", State: "streaming", ReplayLag: 1 * time.Hour},
+	}
+	d := s.newReplicationDiscovery(&replicas)
+	s.Nil(d.discover(context.Background()))
+	s.Equal([]string{"10.0.0.1:5432", "static:5432"}, s.slaveHosts())
+	s.Len(s.cluster.manager.getActiveSlaves(), 2)
+
+	// replica2 caught up, replica1 left
+	replicas = []*Replica{
+		{ClientAddr: "10.0.0.2", ApplicationName: "replica2", State: "streaming"},
+	}
+	removed := d.slaves.conns["10.0.0.1:5432"]
+	s.Nil(d.discover(context.Background()))
+	s.Equal([]string{"10.0.0.2:5432", "static:5432"}, s.slaveHosts())
+	s.True(removed.closed)
+
+	// static slaves are never removed
+	replicas = nil
+	s.Nil(d.discover(context.Background()))
+	s.Equal([]string{"static:5432"}, s.slaveHosts())
+}
+
+func (s *DiscoveryTestSuite) TestReplicationDiscoveryErrors() {
+	replicas := []*Replica{
+		{ClientAddr: "10.0.0.1", ApplicationName: "replica1", State: "streaming"},
+	}
+	d := s.newReplicationDiscovery(&replicas)
+	s.Nil(d.discover(context.Background()))
+
+	// current slaves are kept when listing fails
+	d.listFn = func(ctx context.Context) ([]*Replica, error) {
+		return nil, errors.New("master is down")
+	}
+	s.EqualError(d.discover(context.Background()), "master is down")
+	s.Equal([]string{"10.0.0.1:5432"}, s.slaveHosts())
+
+	d.listFn = func(ctx context.Context) ([]*Replica, error) {
+		return replicas, nil
+	}
+	d.resolver = func(replica *Replica) (*pg.Options, error) {
+		return nil, errors.New("unknown replica")
+	}
+	s.EqualError(d.discover(context.Background()), "replica1: unknown replica")
+	s.Equal([]string{"10.0.0.1:5432"}, s.slaveHosts())
+}
+
+func (s *DiscoveryTestSuite) TestReplicationDiscoveryResolveFailure() {
+	replicas := []*Replica{
+		{ClientAddr: "10.0.0.1", ApplicationName: "replica1", State: "streaming"},
+		{ClientAddr: "10.0.0.2", ApplicationName: "replica2", State: "streaming"},
+		{ClientAddr: "10.0.0.3", ApplicationName: "replica3", State: "streaming"},
+	}
+	d := s.newReplicationDiscovery(&replicas)
+	s.Nil(d.discover(context.Background()))
+
+	// replica1 fails to resolve, replica2 left and replica4 joined
+	resolve := d.resolver
+	d.resolver = func(replica *Replica) (*pg.Options, error) {
+		if replica.ApplicationName == "replica1" {
+			return nil, errors.New("unknown replica")
+		}
+		return resolve(replica)
+	}
+	replicas = []*Replica{
+		{ClientAddr: "10.0.0.1", ApplicationName: "replica1", State: "streaming"},
+		{ClientAddr: "10.0.0.3", ApplicationName: "replica3", State: "streaming"},
+		{ClientAddr: "10.0.0.4", ApplicationName: "replica4", State: "streaming"},
+	}
+	s.EqualError(d.discover(context.Background()), "replica1: unknown replica")
+	s.Equal([]string{"10.0.0.1:5432", "10.0.0.3:5432", "10.0.0.4:5432"}, s.slaveHosts())
+
+	// replica1 which is no longer listed is removed even though it never resolves again
+	replicas = replicas[1:]
+	s.Nil(d.discover(context.Background()))
+	s.Equal([]string{"10.0.0.3:5432", "10.0.0.4:5432"}, s.slaveHosts())
+}
+
+func (s *DiscoveryTestSuite) TestReplicationDiscoveryReportsErrors() {
+	errs := make(chan error, 1)
+	s.cluster.StartReplicationDiscovery(context.Background(), func(replica *Replica) (*pg.Options, error) {
+		return nil, nil
+	}, 0, func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+
+	// the cluster has no master to list replicas from
+	select {
+	case err := <-errs:
+		s.Equal(ErrNoMasterAvailable, err)
+	case <-time.After(time.Second):
+		s.Fail("error was not reported")
+	}
+}
+
+func (s *DiscoveryTestSuite) TestDiscoveryStopsOnShutdown() {
+	replicas := []*Replica{}
+	d := s.newReplicationDiscovery(&replicas)
+	done := make(chan struct{})
+	go func() {
+		d.loop(context.Background())
+		close(done)
+	}()
+
+	s.Nil(s.cluster.Shutdown(context.Background()))
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		s.Fail("discovery loop is still running")
+	}
+}
+
+type fakeResolver struct {
+	hosts []string
+	srvs  []*net.SRV
+	err   error
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return r.hosts, r.err
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return name, r.srvs, r.err
+}
+
+func (s *DiscoveryTestSuite) newDNSDiscovery(d *DNSDiscovery) *dnsDiscovery {
+	d.Options = &pg.Options{User: "user", Database: "db"}
+	return &dnsDiscovery{
+		DNSDiscovery: d,
+		cluster:      s.cluster,
+		slaves:       newSlaveSet(s.cluster),
+	}
+}
+
+func (s *DiscoveryTestSuite) TestDNSDiscovery() {
+	resolver := &fakeResolver{hosts: []string{"10.0.0.1", "10.0.0.2", "fd00::1"}}
+	d := s.newDNSDiscovery(&DNSDiscovery{
+		Name:        "replicas.db.svc.cluster.local",
+		Resolver:    resolver,
+		NodeOptions: []NodeOption{Tags("k8s")},
+	})
+
+	s.Nil(d.discover(context.Background()))
+	s.Equal([]string{"10.0.0.1:5432", "10.0.0.2:5432", "[fd00::1]:5432"}, s.slaveHosts())
+	for _, conn := range s.cluster.manager.getSlaves() {
+		s.Equal([]string{"k8s"}, conn.tags)
+	}
+
+	// scaled down
+	resolver.hosts = []string{"10.0.0.2"}
+	s.Nil(d.discover(context.Background()))
+	s.Equal([]string{"10.0.0.2:5432"}, s.slaveHosts())
+
+	// lookup failure keeps current slaves
+	resolver.err = errors.New("i/o timeout")
+	s.EqualError(d.discover(context.Background()), "i/o timeout")
+	s.Equal([]string{"10.0.0.2:5432"}, s.slaveHosts())
+
+	// scaled to zero, the name has no records left
+	resolver.hosts = nil
+	resolver.err = &net.DNSError{Err: "no such host", Name: d.Name, IsNotFound: true}
+	s.Nil(d.discover(context.Background()))
+	s.Empty(s.slaveHosts())
+}
+
+func (s *DiscoveryTestSuite) TestDNSDiscoveryWithSRV() {
+	resolver := &fakeResolver{srvs: []*net.SRV{
+		{Target: "pod-0.replicas.db.svc.cluster.local.", Port: 5433},
+		{Target: "pod-1.replicas.db.svc.cluster.local.", Port: 5433},
+	}}
+	d := s.newDNSDiscovery(&DNSDiscovery{
+		Name:     "_postgresql._tcp.replicas.db.svc.cluster.local",
+		SRV:      true,
+		Resolver: resolver,
+	})
+
+	s.Nil(d.discover(context.Background()))
+	s.Equal([]string{
+		"pod-0.replicas.db.svc.cluster.local:5433",
+		"pod-1.replicas.db.svc.cluster.local:5433",
+	}, s.slaveHosts())
+}
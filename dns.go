@@ -0,0 +1,146 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+const defaultPort = 5432
+
+// Resolver looks up DNS records, *net.Resolver satisfies it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSDiscovery describes slaves behind a DNS name, such as a Kubernetes headless service.
+type DNSDiscovery struct {
+	// Name is resolved to slave addresses.
+	Name string
+	// SRV resolves Name as SRV record, for example "_postgresql._tcp.replicas.db.svc.cluster.local",
+	// instead of A/AAAA records.
+	SRV bool
+	// Port is used for addresses from A/AAAA records. Defaults to 5432.
+	Port int
+	// Options is used to connect to every discovered address, its Addr is replaced.
+	Options *pg.Options
+	// Interval between lookups, defaults to 30 seconds.
+	Interval time.Duration
+	// Resolver defaults to net.DefaultResolver.
+	Resolver Resolver
+	// NodeOptions are applied to every discovered slave.
+	NodeOptions []NodeOption
+	// OnError is called with errors of every round when it is not nil.
+	OnError func(error)
+}
+
+// StartDNSDiscovery resolves d.Name every d.Interval and makes slaves match the resolved addresses,
+// connecting to new addresses and removing slaves whose address is gone.
+// A name which does not exist, or has no records, removes all slaves discovered through it.
+// Slaves added with AddSlave are left untouched.
+// Discovery stops when ctx is done or the cluster is shut down.
+func (c *Cluster) StartDNSDiscovery(ctx context.Context, d *DNSDiscovery) {
+	go (&dnsDiscovery{
+		DNSDiscovery: d,
+		cluster:      c,
+		slaves:       newSlaveSet(c),
+	}).loop(ctx)
+}
+
+type dnsDiscovery struct {
+	*DNSDiscovery
+	cluster *Cluster
+	slaves  *slaveSet
+}
+
+func (d *dnsDiscovery) loop(ctx context.Context) {
+	d.report(d.discover(ctx))
+
+	ticker := time.NewTicker(pollInterval(d.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.report(d.discover(ctx))
+		case <-ctx.Done():
+			return
+		case <-d.cluster.quitChan:
+			return
+		}
+	}
+}
+
+func (d *dnsDiscovery) report(err error) {
+	if err != nil && d.OnError != nil {
+		d.OnError(err)
+	}
+}
+
+// discover runs one round of discovery, on error current slaves are kept and it is retried next round.
+func (d *dnsDiscovery) discover(ctx context.Context) error {
+	addrs, err := d.lookup(ctx)
+	if err != nil {
+		return err
+	}
+
+	desired := make(map[string]*nodeSpec, len(addrs))
+	for _, addr := range addrs {
+		var opts pg.Options
+		if d.Options != nil {
+			opts = *d.Options
+		}
+		opts.Addr = addr
+		desired[addr] = &nodeSpec{
+			options:  &opts,
+			nodeOpts: d.NodeOptions,
+		}
+	}
+	return d.slaves.reconcile(desired)
+}
+
+func (d *dnsDiscovery) lookup(ctx context.Context) ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	if d.SRV {
+		_, records, err := resolver.LookupSRV(ctx, "", "", d.Name)
+		if err != nil && !isNotFound(err) {
+			return nil, err
+		}
+		addrs := make([]string, 0, len(records))
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+		}
+		return addrs, nil
+	}
+
+	hosts, err := resolver.LookupHost(ctx, d.Name)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	port := d.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	addrs := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return addrs, nil
+}
+
+// isNotFound tells whether a lookup failed because the name has no records,
+// for example a headless service scaled to zero, rather than because DNS is unreachable.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
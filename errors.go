@@ -0,0 +1,118 @@
+package hansip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/go-pg/pg"
+)
+
+// roles of nodes reported by Error
+const (
+	RoleMaster = "master"
+	RoleSlave  = "slave"
+)
+
+// Error wraps an error returned by a node with where it happened.
+// Errors of hansip itself, such as ErrNoSlaveAvailable, are returned as they are.
+// Use errors.As to get it and errors.Is or the Is helpers to classify it.
+type Error struct {
+	// Node is the host the operation ran on.
+	Node string
+	// Role is RoleMaster or RoleSlave.
+	Role string
+	// Op is the operation, one of "query", "exec", "batch", "copy from", "copy to", "begin", "commit" and "rollback".
+	Op string
+	// SQLState is the error code sent by postgres, empty when the error did not come from postgres.
+	SQLState string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("hansip: %s on %s %s: %v", e.Op, e.Role, e.Node, e.Err)
+}
+
+// Unwrap returns the wrapped error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// wrapError wraps err of op on conn, nil and hansip errors without a node are returned as they are.
+func (c *connection) wrapError(op string, err error) error {
+	if err == nil || err == ErrTxFinished {
+		return err
+	}
+	return &Error{
+		Node:     c.host,
+		Role:     c.role,
+		Op:       op,
+		SQLState: SQLState(err),
+		Err:      err,
+	}
+}
+
+// SQLState returns the error code postgres sent with err, it is empty for other errors.
+// See https://www.postgresql.org/docs/current/errcodes-appendix.html.
+func SQLState(err error) string {
+	var pgErr pg.Error
+	if errors.As(err, &pgErr) {
+		return pgErr.Field('C')
+	}
+	return ""
+}
+
+// IsUniqueViolation tells whether err is a unique constraint violation.
+func IsUniqueViolation(err error) bool {
+	return SQLState(err) == "23505"
+}
+
+// IsSerializationFailure tells whether err is a serialization failure or a deadlock,
+// the transaction can be retried from the start.
+func IsSerializationFailure(err error) bool {
+	state := SQLState(err)
+	return state == "40001" || state == "40P01"
+}
+
+// IsReadOnlyViolation tells whether err comes from writing on a read only node,
+// for example a slave or a master which was demoted.
+func IsReadOnlyViolation(err error) bool {
+	return SQLState(err) == "25006"
+}
+
+// IsConnectionError tells whether err means the node could not be reached or dropped the connection,
+// rather than rejecting the query. The query may have run when the connection dropped mid way.
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrNoMasterAvailable) || errors.Is(err, ErrNoSlaveAvailable) || errors.Is(err, errNoPool) {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	state := SQLState(err)
+	// class 08 is connection exception, 57P0x are shutdowns of the server
+	if strings.HasPrefix(state, "08") || state == "57P01" || state == "57P02" || state == "57P03" {
+		return true
+	}
+	return strings.Contains(err.Error(), "pg: database is closed")
+}
+
+// IsAuthError tells whether err means the node rejected credentials or they could not be fetched.
+func IsAuthError(err error) bool {
+	var credErr *credentialError
+	if errors.As(err, &credErr) {
+		return true
+	}
+	// class 28 is invalid authorization specification
+	return strings.HasPrefix(SQLState(err), "28")
+}
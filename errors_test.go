@@ -0,0 +1,122 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ErrorTestSuite struct {
+	suite.Suite
+}
+
+func TestError(t *testing.T) {
+	s := &ErrorTestSuite{}
+	suite.Run(t, s)
+}
+
+// fakePGError mimics errors sent by postgres
+type fakePGError struct {
+	code     string
+	message  string
+	position string
+}
+
+func (e *fakePGError) Field(field byte) string {
+	switch field {
+	case 'C':
+		return e.code
+	case 'M':
+		return e.message
+	case 'P':
+		return e.position
+	}
+	return ""
+}
+
+func (e *fakePGError) IntegrityViolation() bool {
+	return e.code[:2] == "23"
+}
+
+func (e *fakePGError) Error() string {
+	return "ERROR #" + e.code + " " + e.message
+}
+
+// failingSQL returns err from every operation
+type failingSQL struct {
+	err error
+}
+
+func (f *failingSQL) query(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return f.err
+}
+
+func (f *failingSQL) exec(ctx context.Context, query string, args ...interface{}) error {
+	return f.err
+}
+
+func (f *failingSQL) newTransaction(ctx context.Context) (CopyTransaction, error) {
+	return nil, f.err
+}
+
+func (f *failingSQL) copyFrom(ctx context.Context, r io.Reader, query string, args ...interface{}) (int, error) {
+	return 0, f.err
+}
+
+func (f *failingSQL) copyTo(ctx context.Context, w io.Writer, query string, args ...interface{}) (int, error) {
+	return 0, f.err
+}
+
+func (f *failingSQL) batch(ctx context.Context, statements []batchStatement) ([]BatchResult, error) {
+	return batchResults(len(statements), 0, f.err), f.err
+}
+
+func (s *ErrorTestSuite) TestWrapsNodeErrors() {
+	pgErr := &fakePGError{code: "23505", message: "duplicate key value violates unique constraint"}
+	conn := &connection{host: "db1:5432", role: RoleMaster, s: &failingSQL{err: pgErr}}
+
+	err := conn.exec(context.Background(), "insert into users values (1);")
+	var hansipErr *Error
+	s.True(errors.As(err, &hansipErr))
+	s.Equal("db1:5432", hansipErr.Node)
+	s.Equal(RoleMaster, hansipErr.Role)
+	s.Equal("exec", hansipErr.Op)
+	s.Equal("23505", hansipErr.SQLState)
+	s.True(errors.Is(err, pgErr))
+	s.EqualError(err, "hansip: exec on master db1:5432: ERROR #23505 duplicate key value violates unique constraint")
+
+	_, err = conn.newTransaction(context.Background())
+	s.True(errors.As(err, &hansipErr))
+	s.Equal("begin", hansipErr.Op)
+
+	s.Nil(conn.wrapError("query", nil))
+	s.Equal(ErrTxFinished, conn.wrapError("commit", ErrTxFinished))
+}
+
+func (s *ErrorTestSuite) TestClassification() {
+	wrap := func(err error) error {
+		conn := &connection{host: "db1:5432", role: RoleSlave}
+		return conn.wrapError("query", err)
+	}
+
+	s.True(IsUniqueViolation(wrap(&fakePGError{code: "23505"})))
+	s.False(IsUniqueViolation(wrap(&fakePGError{code: "23503"})))
+	s.True(IsSerializationFailure(wrap(&fakePGError{code: "40001"})))
+	s.True(IsSerializationFailure(wrap(&fakePGError{code: "40P01"})))
+	s.True(IsReadOnlyViolation(wrap(&fakePGError{code: "25006"})))
+	s.True(IsAuthError(wrap(&fakePGError{code: "28P01"})))
+	s.True(IsAuthError(&credentialError{err: errors.New("token expired")}))
+	s.Equal("", SQLState(errors.New("boom")))
+
+	s.True(IsConnectionError(wrap(&fakePGError{code: "57P01"})))
+	s.True(IsConnectionError(wrap(&fakePGError{code: "08006"})))
+	s.True(IsConnectionError(wrap(io.EOF)))
+	s.True(IsConnectionError(wrap(&net.OpError{Op: "dial", Err: errors.New("connection refused")})))
+	s.True(IsConnectionError(ErrNoMasterAvailable))
+	s.False(IsConnectionError(wrap(&fakePGError{code: "23505"})))
+	s.False(IsConnectionError(nil))
+}
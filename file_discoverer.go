@@ -0,0 +1,75 @@
+package hansip
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// FileDiscoverer watches a config file in any format supported by LoadConfigFile.
+// Its master and slave urls make the topology, other settings are ignored.
+type FileDiscoverer struct {
+	Path string
+	// Interval between checks of file content, defaults to 30 seconds.
+	Interval time.Duration
+}
+
+// Watch implements Discoverer. Topology is sent when file content changes,
+// files which can not be read or are not valid are skipped until they change again.
+func (f *FileDiscoverer) Watch(ctx context.Context) <-chan Topology {
+	topologies := make(chan Topology)
+	go func() {
+		defer close(topologies)
+
+		ticker := time.NewTicker(pollInterval(f.Interval))
+		defer ticker.Stop()
+
+		var previous []byte
+		for {
+			content, err := ioutil.ReadFile(f.Path)
+			if err == nil && (previous == nil || !bytes.Equal(previous, content)) {
+				previous = content
+				if topology, err := f.load(); err == nil {
+					select {
+					case topologies <- topology:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return topologies
+}
+
+func (f *FileDiscoverer) load() (Topology, error) {
+	cc, err := LoadConfigFile(f.Path)
+	if err != nil {
+		return Topology{}, err
+	}
+	if err := cc.Validate(); err != nil {
+		return Topology{}, err
+	}
+
+	var topology Topology
+	if topology.Master, err = pg.ParseURL(cc.Master.URL); err != nil {
+		return Topology{}, err
+	}
+	for _, slave := range cc.Slaves {
+		opts, err := pg.ParseURL(slave.URL)
+		if err != nil {
+			return Topology{}, err
+		}
+		topology.Slaves = append(topology.Slaves, opts)
+	}
+	return topology, nil
+}
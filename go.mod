@@ -1,6 +1,7 @@
 module github.com/asasmoyo/pg-hansip
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/go-pg/pg v8.0.4+incompatible
 	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/jinzhu/inflection v0.0.0-20180308033659-04140366298a // indirect
@@ -13,6 +14,6 @@ require (
 	golang.org/x/sys v0.0.0-20190429094411-2cc0cad0ac78 // indirect
 	golang.org/x/text v0.3.2 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
-	gopkg.in/yaml.v2 v2.2.2 // indirect
+	gopkg.in/yaml.v2 v2.2.2
 	mellium.im/sasl v0.2.1 // indirect
 )
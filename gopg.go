@@ -1,36 +1,325 @@
 package hansip
 
 import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"unicode/utf8"
+
 	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	"github.com/go-pg/pg/types"
 )
 
+// errNoPool is returned by nodes whose pool could not be created yet, for example without credentials
+var errNoPool = errors.New("connection pool is not created yet")
+
 type gopgSQL struct {
-	db *pg.DB
+	// refresh is called before a pool is handed out, it may replace the pool with new credentials
+	refresh func(ctx context.Context) error
+
+	// db is replaced when the pool is rebuilt, for example with new credentials.
+	// users counts statements and transactions per pool, a replaced pool is kept in retired
+	// and closed once its last user is done.
+	mutex   sync.RWMutex
+	db      *pg.DB
+	users   map[*pg.DB]int
+	retired map[*pg.DB]bool
+}
+
+func (s *gopgSQL) getDB() *pg.DB {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.db
+}
+
+// setDB sets the pool of a node without one.
+func (s *gopgSQL) setDB(db *pg.DB) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.db = db
+}
+
+// replaceDB replaces the pool, the previous one is closed once it is not used anymore.
+func (s *gopgSQL) replaceDB(db *pg.DB) {
+	s.mutex.Lock()
+	previous := s.db
+	s.db = db
+	if previous == nil || s.users[previous] == 0 {
+		s.mutex.Unlock()
+		if previous != nil {
+			previous.Close()
+		}
+		return
+	}
+	if s.retired == nil {
+		s.retired = map[*pg.DB]bool{}
+	}
+	s.retired[previous] = true
+	s.mutex.Unlock()
+}
+
+// acquire refreshes the pool and hands it out until release is called.
+// A failed refresh keeps the current pool, the error is reported by the next health check.
+func (s *gopgSQL) acquire(ctx context.Context) (*pg.DB, func(), error) {
+	if s.refresh != nil {
+		if err := s.refresh(ctx); err != nil && s.getDB() == nil {
+			return nil, nil, err
+		}
+	}
+	return s.use()
+}
+
+// use hands out the current pool until release is called.
+func (s *gopgSQL) use() (*pg.DB, func(), error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	db := s.db
+	if db == nil {
+		return nil, nil, errNoPool
+	}
+	if s.users == nil {
+		s.users = map[*pg.DB]int{}
+	}
+	s.users[db]++
+	return db, func() { s.release(db) }, nil
+}
+
+func (s *gopgSQL) release(db *pg.DB) {
+	s.mutex.Lock()
+	s.users[db]--
+	if s.users[db] > 0 {
+		s.mutex.Unlock()
+		return
+	}
+	delete(s.users, db)
+	retired := s.retired[db]
+	delete(s.retired, db)
+	s.mutex.Unlock()
+	if retired {
+		db.Close()
+	}
 }
 
-func (s *gopgSQL) query(dest interface{}, query string, args ...interface{}) error {
+// close closes the current pool and the retired ones still in use.
+func (s *gopgSQL) close() {
+	s.mutex.Lock()
+	pools := []*pg.DB{}
+	if s.db != nil {
+		pools = append(pools, s.db)
+	}
+	for db := range s.retired {
+		pools = append(pools, db)
+	}
+	s.db, s.retired = nil, nil
+	s.mutex.Unlock()
+	for _, db := range pools {
+		db.Close()
+	}
+}
+
+func (s *gopgSQL) query(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	db, release, err := s.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
 	query = injectCallerInfo(query)
-	_, err := s.db.Query(dest, query, args...)
-	return err
+	return runScoped(ctx, db, func(q gopgQuerier) error {
+		_, err := q.QueryContext(ctx, dest, query, args...)
+		return err
+	})
 }
 
-func (s *gopgSQL) exec(query string, args ...interface{}) error {
+func (s *gopgSQL) exec(ctx context.Context, query string, args ...interface{}) error {
+	db, release, err := s.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
 	query = injectCallerInfo(query)
-	_, err := s.db.Exec(query, args...)
-	return err
+	return runScoped(ctx, db, func(q gopgQuerier) error {
+		_, err := q.ExecContext(ctx, query, args...)
+		return err
+	})
 }
 
-func (s *gopgSQL) newTransaction() (Transaction, error) {
-	tx, err := s.db.Begin()
+func (s *gopgSQL) copyFrom(ctx context.Context, r io.Reader, query string, args ...interface{}) (int, error) {
+	db, release, err := s.acquire(ctx)
 	if err != nil {
+		return 0, err
+	}
+	defer release()
+	query = injectCallerInfo(query)
+	var rows int
+	err = runScoped(ctx, db, func(q gopgQuerier) error {
+		res, err := copyCancellable(ctx, db, q, func(q gopgQuerier) (pg.Result, error) {
+			return q.CopyFrom(&contextReader{ctx: ctx, r: r}, query, args...)
+		})
+		if err != nil {
+			return err
+		}
+		rows = res.RowsAffected()
+		return nil
+	})
+	return rows, err
+}
+
+func (s *gopgSQL) copyTo(ctx context.Context, w io.Writer, query string, args ...interface{}) (int, error) {
+	db, release, err := s.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	query = injectCallerInfo(query)
+	var rows int
+	err = runScoped(ctx, db, func(q gopgQuerier) error {
+		res, err := copyCancellable(ctx, db, q, func(q gopgQuerier) (pg.Result, error) {
+			return q.CopyTo(&contextWriter{ctx: ctx, w: w}, query, args...)
+		})
+		if err != nil {
+			return err
+		}
+		rows = res.RowsAffected()
+		return nil
+	})
+	return rows, err
+}
+
+// batch sends settings of ctx and statements as one multi-statement query.
+// go-pg keeps only the last command-complete message of such a query, so every statement is rewritten
+// to end with a row counting its rows, see countingStatement, and the statement which failed is the one
+// after the last counted. Errors found before any statement runs are mapped back by their position.
+func (s *gopgSQL) batch(ctx context.Context, statements []batchStatement) ([]BatchResult, error) {
+	db, release, err := s.acquire(ctx)
+	if err != nil {
+		return batchResults(len(statements), -1, err), err
+	}
+	defer release()
+
+	query := injectCallerInfo("")
+	for _, setting := range localSettings(ctx) {
+		query += string(db.FormatQuery(nil, setting.query, setting.args...)) + "\n"
+	}
+	query += "select null as " + batchBeginColumn + ";\n"
+	starts := make([]int, len(statements))
+	for i, statement := range statements {
+		starts[i] = utf8.RuneCountInString(query)
+		query += countingStatement(string(db.FormatQuery(nil, statement.query, statement.args...))) + ";\n"
+	}
+
+	model := &batchModel{n: len(statements)}
+	if _, err := db.QueryContext(ctx, model, batchQuery(query)); err != nil {
+		failed := model.failed()
+		if failed < 0 {
+			failed = failedStatement(starts, err)
+		}
+		return batchResults(len(statements), failed, err), err
+	}
+	return model.results, nil
+}
+
+// batchQuery is a batch formatted already, so go-pg sends it without looking for placeholders.
+type batchQuery string
+
+func (q batchQuery) AppendQuery(b []byte) ([]byte, error) {
+	return append(b, q...), nil
+}
+
+// batchModel collects rows of a batch query into results of its statements.
+type batchModel struct {
+	n       int
+	results []BatchResult
+	// begun is set once settings preceding statements were applied
+	begun bool
+	// next is the statement whose rows are read
+	next int
+	// returned counts rows returned by the next statement
+	returned int
+}
+
+func (m *batchModel) Init() error {
+	*m = batchModel{n: m.n, results: make([]BatchResult, m.n)}
+	return nil
+}
+
+func (m *batchModel) NewModel() orm.ColumnScanner {
+	return &batchRow{}
+}
+
+func (m *batchModel) AddModel(scanner orm.ColumnScanner) error {
+	row := scanner.(*batchRow)
+	switch {
+	case row.begin:
+		m.begun = true
+		m.returned = 0
+	case row.end && m.next < m.n:
+		m.results[m.next].RowsAffected = m.returned
+		if row.counted {
+			m.results[m.next].RowsAffected = row.rows
+		}
+		m.next++
+		m.returned = 0
+	default:
+		m.returned++
+	}
+	return nil
+}
+
+// failed returns the statement which failed the batch, or -1 when it is not known.
+func (m *batchModel) failed() int {
+	if !m.begun || m.next >= m.n {
+		return -1
+	}
+	return m.next
+}
+
+// batchRow is a row of a batch query, rows of statements are only counted.
+type batchRow struct {
+	begin, end, counted bool
+	rows                int
+}
+
+func (r *batchRow) ScanColumn(colIdx int, colName string, rd types.Reader, n int) error {
+	switch colName {
+	case batchBeginColumn:
+		r.begin = true
+	case batchRowsColumn:
+		r.end = true
+		if n >= 0 {
+			var err error
+			r.rows, err = types.ScanInt(rd, n)
+			r.counted = err == nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *gopgSQL) newTransaction(ctx context.Context) (CopyTransaction, error) {
+	db, release, err := s.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if err := applyLocalSettings(ctx, tx); err != nil {
+		tx.Rollback()
+		release()
 		return nil, err
 	}
-	return &gopgTransaction{db: tx}, nil
+	return &gopgTransaction{db: tx, release: release}, nil
 }
 
 type gopgTransaction struct {
 	db       *pg.Tx
 	finished bool
+	// release gives the pool back once the transaction is finished
+	release func()
 }
 
 func (tx *gopgTransaction) Query(dest interface{}, query string, args ...interface{}) error {
@@ -45,12 +334,31 @@ func (tx *gopgTransaction) Exec(query string, args ...interface{}) error {
 	return err
 }
 
+func (tx *gopgTransaction) CopyFrom(r io.Reader, query string, args ...interface{}) (int, error) {
+	query = injectCallerInfo(query)
+	res, err := tx.db.CopyFrom(r, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
+
+func (tx *gopgTransaction) CopyTo(w io.Writer, query string, args ...interface{}) (int, error) {
+	query = injectCallerInfo(query)
+	res, err := tx.db.CopyTo(w, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
+
 func (tx *gopgTransaction) Commit() error {
 	if tx.finished {
 		return ErrTxFinished
 	}
 	err := tx.db.Commit()
 	tx.finished = true
+	tx.release()
 	return err
 }
 
@@ -60,5 +368,6 @@ func (tx *gopgTransaction) Rollback() error {
 	}
 	err := tx.db.Rollback()
 	tx.finished = true
+	tx.release()
 	return err
 }
@@ -11,6 +11,21 @@ var (
 
 // NewCluster creates new cluster.
 func NewCluster(conf *Config) *Cluster {
+	conf.setDefaults()
+
+	manager := newConnectionManager(conf.ConnCheckDelay)
+	manager.setLocality(conf.LocalZone, conf.SaturationThreshold)
+	cluster := &Cluster{
+		manager:  manager,
+		conf:     conf,
+		drained:  make(chan struct{}),
+		quitChan: make(chan struct{}),
+	}
+	cluster.configSlaves = newSlaveSet(cluster)
+	return cluster
+}
+
+func (conf *Config) setDefaults() {
 	if conf.MaxConnAttempt == 0 {
 		conf.MaxConnAttempt = defaultMaxAttempt
 	}
@@ -23,10 +38,10 @@ func NewCluster(conf *Config) *Cluster {
 	if conf.ConnPingTimeout == 0 {
 		conf.ConnPingTimeout = defaultConnPingTimeout
 	}
-
-	manager := newConnectionManager(conf.ConnCheckDelay)
-	return &Cluster{
-		manager: manager,
-		conf:    conf,
+	if conf.FailureThreshold == 0 {
+		conf.FailureThreshold = defaultFailureThreshold
+	}
+	if conf.SuccessThreshold == 0 {
+		conf.SuccessThreshold = defaultSuccessThreshold
 	}
 }
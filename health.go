@@ -0,0 +1,107 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-pg/pg"
+)
+
+var errUnhealthy = errors.New("health check condition is not met")
+
+const defaultHealthCheckQuery = "select 1;"
+
+// Node describes a database server being health checked.
+type Node struct {
+	Host string
+	DB   *pg.DB
+}
+
+// HealthCheck checks whether given node is healthy.
+// Returning an error marks the ping as failed.
+// ctx is done after Config.ConnPingTimeout, the check should give up then, for example by passing ctx to queries.
+// A check which keeps running past its timeout counts as failed and no other check of the node starts until it returns.
+type HealthCheck func(ctx context.Context, node *Node) error
+
+// HealthCheckQuery creates HealthCheck which runs given query.
+// The node is healthy when the query runs without error.
+func HealthCheckQuery(query string) HealthCheck {
+	return func(ctx context.Context, node *Node) error {
+		_, err := node.DB.ExecContext(ctx, query)
+		return err
+	}
+}
+
+// HealthCheckCondition creates HealthCheck which runs given query returning a single boolean.
+// The node is healthy when the query returns true, for example:
+//
+//	select exists(select 1 from pg_extension where extname = 'postgis');
+func HealthCheckCondition(query string) HealthCheck {
+	return func(ctx context.Context, node *Node) error {
+		var ok bool
+		if _, err := node.DB.QueryOneContext(ctx, pg.Scan(&ok), query); err != nil {
+			return err
+		}
+		if !ok {
+			return errUnhealthy
+		}
+		return nil
+	}
+}
+
+// NodeState is the health state of a node.
+type NodeState string
+
+// node states reported by Cluster.Health
+const (
+	NodeUp   NodeState = "up"
+	NodeDown NodeState = "down"
+	// NodeAuthFailed means the node rejected its credentials or they could not be fetched
+	NodeAuthFailed NodeState = "auth_failed"
+	// NodeTLSFailed means TLS handshake with the node failed, for example its certificate was rejected
+	NodeTLSFailed NodeState = "tls_failed"
+)
+
+// NodeHealth reports health of a node.
+type NodeHealth struct {
+	Host   string
+	Master bool
+	Tags   []string
+	Zone   string
+	State  NodeState
+	// LastError is the error of the last health check, nil when it succeeded
+	LastError error
+}
+
+// Health reports health of master and slaves, master comes first.
+func (c *Cluster) Health() []NodeHealth {
+	var health []NodeHealth
+	if master := c.manager.getMaster(); master != nil {
+		health = append(health, master.health(true))
+	}
+	for _, conn := range c.manager.getSlaves() {
+		health = append(health, conn.health(false))
+	}
+	return health
+}
+
+func (c *connection) health(master bool) NodeHealth {
+	err := c.getLastErr()
+	state := NodeDown
+	switch {
+	case c.getConnected():
+		state = NodeUp
+	case isTLSError(err):
+		state = NodeTLSFailed
+	case IsAuthError(err):
+		state = NodeAuthFailed
+	}
+	return NodeHealth{
+		Host:      c.host,
+		Master:    master,
+		Tags:      c.tags,
+		Zone:      c.zone,
+		State:     state,
+		LastError: err,
+	}
+}
@@ -0,0 +1,64 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/stretchr/testify/suite"
+)
+
+type HealthCheckTestSuite struct {
+	TestSuite
+}
+
+func TestHealthCheck(t *testing.T) {
+	s := &HealthCheckTestSuite{}
+	s.noCreateCluster = true
+	suite.Run(t, s)
+}
+
+func (s *HealthCheckTestSuite) newConfig(healthCheck HealthCheck) *Config {
+	return &Config{
+		ConnPingTimeout: 1 * time.Second,
+		ConnCheckDelay:  100 * time.Millisecond,
+		HealthCheck:     healthCheck,
+	}
+}
+
+func (s *HealthCheckTestSuite) TestCustomHealthCheck() {
+	var host string
+	conf := s.newConfig(func(ctx context.Context, node *Node) error {
+		host = node.Host
+		return nil
+	})
+	conn, err := newConnection(&pg.Options{Addr: "dummy:5432"}, conf, newNodeOptions(nil))
+	s.Nil(err)
+	s.True(conn.getConnected())
+	s.Equal("dummy:5432", host)
+	conn.quit()
+}
+
+func (s *HealthCheckTestSuite) TestCustomHealthCheckFails() {
+	conf := s.newConfig(func(ctx context.Context, node *Node) error {
+		return errors.New("extension is missing")
+	})
+	conn, err := newConnection(&pg.Options{Addr: "dummy:5432"}, conf, newNodeOptions(nil))
+	s.EqualError(err, "extension is missing")
+	s.Nil(conn)
+}
+
+func (s *HealthCheckTestSuite) TestHealthCheckCondition() {
+	conf := s.newConfig(HealthCheckCondition("select true;"))
+	conn, err := newConnection(s.getMasterConnectionInfo(), conf, newNodeOptions(nil))
+	s.Nil(err)
+	s.True(conn.getConnected())
+	conn.quit()
+
+	conf = s.newConfig(HealthCheckCondition("select false;"))
+	conn, err = newConnection(s.getMasterConnectionInfo(), conf, newNodeOptions(nil))
+	s.Equal(errUnhealthy, err)
+	s.Nil(conn)
+}
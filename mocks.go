@@ -1,20 +1,111 @@
 package hansip
 
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+)
+
 type dummySQL struct {
-	queryRun, execRun, newTransactionRun bool
+	queryRun, execRun, newTransactionRun, batchRun, copyRun bool
+
+	// when set, query blocks until it is closed or ctx is done
+	block chan struct{}
+	// when set, query returns its result
+	queryFn func(dest interface{}) error
 }
 
-func (d *dummySQL) query(dest interface{}, query string, args ...interface{}) error {
+func (d *dummySQL) query(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
 	d.queryRun = true
+	if d.block != nil {
+		select {
+		case <-d.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if d.queryFn != nil {
+		return d.queryFn(dest)
+	}
 	return nil
 }
 
-func (d *dummySQL) exec(query string, args ...interface{}) error {
+func (d *dummySQL) exec(ctx context.Context, query string, args ...interface{}) error {
 	d.execRun = true
 	return nil
 }
 
-func (d *dummySQL) newTransaction() (Transaction, error) {
+func (d *dummySQL) newTransaction(ctx context.Context) (CopyTransaction, error) {
 	d.newTransactionRun = true
-	return nil, nil
+	return &dummyTransaction{}, nil
+}
+
+func (d *dummySQL) batch(ctx context.Context, statements []batchStatement) ([]BatchResult, error) {
+	d.batchRun = true
+	return batchResults(len(statements), -1, nil), nil
+}
+
+func (d *dummySQL) copyFrom(ctx context.Context, r io.Reader, query string, args ...interface{}) (int, error) {
+	d.copyRun = true
+	return countLines(r)
+}
+
+func (d *dummySQL) copyTo(ctx context.Context, w io.Writer, query string, args ...interface{}) (int, error) {
+	d.copyRun = true
+	_, err := io.WriteString(w, "1\n")
+	return 1, err
+}
+
+// countLines counts rows of text format copy data
+func countLines(r io.Reader) (int, error) {
+	data, err := ioutil.ReadAll(r)
+	return bytes.Count(data, []byte("\n")), err
+}
+
+type dummyTransaction struct {
+	committed, rolledBack bool
+}
+
+func (tx *dummyTransaction) Query(dest interface{}, query string, args ...interface{}) error {
+	return nil
+}
+
+func (tx *dummyTransaction) Exec(query string, args ...interface{}) error {
+	return nil
+}
+
+func (tx *dummyTransaction) CopyFrom(r io.Reader, query string, args ...interface{}) (int, error) {
+	return countLines(r)
+}
+
+func (tx *dummyTransaction) CopyTo(w io.Writer, query string, args ...interface{}) (int, error) {
+	_, err := io.WriteString(w, "1\n")
+	return 1, err
+}
+
+func (tx *dummyTransaction) Commit() error {
+	tx.committed = true
+	return nil
+}
+
+func (tx *dummyTransaction) Rollback() error {
+	tx.rolledBack = true
+	return nil
+}
+
+// newDummyCluster creates a cluster with slaves and a connected master backed by the returned dummySQL.
+func newDummyCluster(conf *Config, slaves ...*connection) (*Cluster, *dummySQL) {
+	manager := &connectionManager{}
+	for _, slave := range slaves {
+		manager.addSlave(slave)
+	}
+	master := &dummySQL{}
+	manager.master = &connection{connected: 1, s: master}
+	return &Cluster{manager: manager, conf: conf}, master
+}
+
+// newDummySlave creates a connected slave with given host, zone and tags backed by a dummySQL.
+func newDummySlave(host, zone string, tags ...string) *connection {
+	return &connection{host: host, zone: zone, tags: tags, connected: 1, s: &dummySQL{}}
 }
@@ -0,0 +1,210 @@
+package hansip
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// target_session_attrs values, they follow libpq semantics adapted to master/slave routing
+const (
+	// master is required, other servers become slaves
+	sessionAttrsReadWrite = "read-write"
+	sessionAttrsPrimary   = "primary"
+	// at least one standby is required, primary is not used
+	sessionAttrsReadOnly = "read-only"
+	sessionAttrsStandby  = "standby"
+	// reads go to standbys, primary is used as master and as reader of last resort
+	sessionAttrsPreferStandby = "prefer-standby"
+	// every reachable server serves reads, including primary
+	sessionAttrsAny = "any"
+)
+
+// probeRecovery tells whether server at given options is a standby
+var probeRecovery = func(opts *pg.Options, timeout time.Duration) (bool, error) {
+	db := pg.Connect(opts)
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var inRecovery bool
+	_, err := db.QueryOneContext(ctx, pg.Scan(&inRecovery), "select pg_is_in_recovery();")
+	return inRecovery, err
+}
+
+// NewClusterFromURL creates a cluster from a libpq style url listing multiple hosts such as
+//
+//	postgres://user:pass@h1,h2:5433,h3/db?target_session_attrs=read-write
+//
+// Every host is probed with pg_is_in_recovery() to find out whether it is a primary or a standby.
+// target_session_attrs decides how they are used:
+//
+//	read-write, primary  primary becomes master and standbys become slaves, a primary is required
+//	read-only, standby   standbys become slaves and there is no master, a standby is required
+//	prefer-standby       same as read-write, but works without primary or without standby
+//	any                  same as prefer-standby, and primary serves reads along with standbys (default)
+//
+// Hosts which can not be reached while probing are added as slaves in disconnected state,
+// like with Config.LazyConnect, and start serving reads once they answer health checks.
+// Unless target_session_attrs is any, they also have to be in recovery to pass health checks,
+// so a primary which was down does not serve reads as a slave when it comes back.
+// Finding more than one primary is an error unless primaries are not used.
+func NewClusterFromURL(rawURL string, conf *Config) (*Cluster, error) {
+	hosts, attrs, err := parseMultiHostURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster := NewCluster(conf)
+	if err := cluster.addProbedHosts(hosts, attrs); err != nil {
+		cluster.Shutdown(context.Background())
+		return nil, err
+	}
+	return cluster, nil
+}
+
+func (c *Cluster) addProbedHosts(hosts []*pg.Options, attrs string) error {
+	var primaries, standbys, unreachable []*pg.Options
+	for _, opts := range hosts {
+		inRecovery, err := probeRecovery(opts, c.getConfig().ConnPingTimeout)
+		if err != nil {
+			unreachable = append(unreachable, opts)
+			continue
+		}
+		if inRecovery {
+			standbys = append(standbys, opts)
+		} else {
+			primaries = append(primaries, opts)
+		}
+	}
+
+	switch attrs {
+	case sessionAttrsReadWrite, sessionAttrsPrimary:
+		if len(primaries) == 0 {
+			return fmt.Errorf("target_session_attrs=%s: no primary found among %s", attrs, hostList(hosts))
+		}
+	case sessionAttrsReadOnly, sessionAttrsStandby:
+		if len(standbys) == 0 {
+			return fmt.Errorf("target_session_attrs=%s: no standby found among %s", attrs, hostList(hosts))
+		}
+		primaries = nil
+	default:
+		if len(primaries) == 0 && len(standbys) == 0 {
+			return fmt.Errorf("target_session_attrs=%s: no server reachable among %s", attrs, hostList(hosts))
+		}
+	}
+
+	// primaries are not failed over automatically, two of them mean a split brain or a stale url
+	if len(primaries) > 1 {
+		return fmt.Errorf("target_session_attrs=%s: multiple primaries found: %s", attrs, hostList(primaries))
+	}
+	if len(primaries) > 0 {
+		if err := c.SetMaster(primaries[0]); err != nil {
+			return fmt.Errorf("%s: %w", primaries[0].Addr, err)
+		}
+		if attrs == sessionAttrsAny {
+			standbys = append(standbys, primaries[0])
+		}
+	}
+	for _, opts := range standbys {
+		if err := c.AddSlave(opts); err != nil {
+			return fmt.Errorf("%s: %w", opts.Addr, err)
+		}
+	}
+
+	lazy := *c.getConfig()
+	lazy.LazyConnect = true
+	if attrs != sessionAttrsAny {
+		lazy.HealthCheck = requireStandby(lazy.HealthCheck)
+	}
+	for _, opts := range unreachable {
+		if err := c.addSlave(opts, &lazy, nil); err != nil {
+			return fmt.Errorf("%s: %w", opts.Addr, err)
+		}
+	}
+	return nil
+}
+
+// parseMultiHostURL splits a libpq style url with comma separated hosts into options of each host.
+func parseMultiHostURL(rawURL string) ([]*pg.Options, string, error) {
+	schemeEnd := strings.Index(rawURL, "://")
+	if schemeEnd < 0 {
+		return nil, "", fmt.Errorf("invalid url %q", rawURL)
+	}
+	scheme, rest := rawURL[:schemeEnd], rawURL[schemeEnd+3:]
+
+	authorityEnd := strings.IndexAny(rest, "/?")
+	if authorityEnd < 0 {
+		authorityEnd = len(rest)
+	}
+	authority, tail := rest[:authorityEnd], rest[authorityEnd:]
+
+	var userInfo string
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		userInfo, authority = authority[:at+1], authority[at+1:]
+	}
+
+	// target_session_attrs is not understood by go-pg, take it out before parsing each host
+	path, rawQuery := tail, ""
+	if q := strings.Index(tail, "?"); q >= 0 {
+		path, rawQuery = tail[:q], tail[q+1:]
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, "", err
+	}
+	attrs := sessionAttrsAny
+	if val := query.Get("target_session_attrs"); val != "" {
+		attrs = val
+	}
+	query.Del("target_session_attrs")
+	switch attrs {
+	case sessionAttrsReadWrite, sessionAttrsPrimary, sessionAttrsReadOnly, sessionAttrsStandby, sessionAttrsPreferStandby, sessionAttrsAny:
+	default:
+		return nil, "", fmt.Errorf("target_session_attrs %q is not supported", attrs)
+	}
+	if encoded := query.Encode(); encoded != "" {
+		path += "?" + encoded
+	}
+
+	var hosts []*pg.Options
+	for _, host := range strings.Split(authority, ",") {
+		if host == "" {
+			return nil, "", fmt.Errorf("invalid url %q: empty host", rawURL)
+		}
+		opts, err := pg.ParseURL(scheme + "://" + userInfo + host + path)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", host, err)
+		}
+		hosts = append(hosts, opts)
+	}
+	return hosts, attrs, nil
+}
+
+func hostList(hosts []*pg.Options) string {
+	addrs := make([]string, 0, len(hosts))
+	for _, opts := range hosts {
+		addrs = append(addrs, opts.Addr)
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// standbyCheck passes while the node is in recovery, it is replaced in tests.
+var standbyCheck = HealthCheckCondition("select pg_is_in_recovery();")
+
+// requireStandby wraps check so that the node is only healthy while it is a standby.
+func requireStandby(check HealthCheck) HealthCheck {
+	return func(ctx context.Context, node *Node) error {
+		if check != nil {
+			if err := check(ctx, node); err != nil {
+				return err
+			}
+		}
+		return standbyCheck(ctx, node)
+	}
+}
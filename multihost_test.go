@@ -0,0 +1,202 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/stretchr/testify/suite"
+)
+
+type MultiHostTestSuite struct {
+	suite.Suite
+	originalProbe        func(*pg.Options, time.Duration) (bool, error)
+	originalStandbyCheck HealthCheck
+}
+
+func TestMultiHost(t *testing.T) {
+	s := &MultiHostTestSuite{}
+	suite.Run(t, s)
+}
+
+func (s *MultiHostTestSuite) SetupTest() {
+	s.originalProbe = probeRecovery
+	s.originalStandbyCheck = standbyCheck
+}
+
+func (s *MultiHostTestSuite) TearDownTest() {
+	probeRecovery = s.originalProbe
+	standbyCheck = s.originalStandbyCheck
+}
+
+// stubRoles makes probing report primary and standby hosts, other hosts are unreachable.
+// Health checks of unreachable hosts find them in recovery.
+func (s *MultiHostTestSuite) stubRoles(primaries, standbys []string) {
+	standbyCheck = func(ctx context.Context, node *Node) error {
+		return nil
+	}
+	probeRecovery = func(opts *pg.Options, timeout time.Duration) (bool, error) {
+		for _, host := range primaries {
+			if opts.Addr == host {
+				return false, nil
+			}
+		}
+		for _, host := range standbys {
+			if opts.Addr == host {
+				return true, nil
+			}
+		}
+		return false, errors.New("connection refused")
+	}
+}
+
+func (s *MultiHostTestSuite) newConfig() *Config {
+	return &Config{
+		ConnCheckDelay: 1 * time.Hour,
+		HealthCheck: func(ctx context.Context, node *Node) error {
+			return nil
+		},
+	}
+}
+
+func (s *MultiHostTestSuite) slaveHosts(cluster *Cluster) []string {
+	var hosts []string
+	for _, conn := range cluster.manager.getSlaves() {
+		hosts = append(hosts, conn.host)
+	}
+	return hosts
+}
+
+func (s *MultiHostTestSuite) TestParseMultiHostURL() {
+	hosts, attrs, err := parseMultiHostURL("postgres://user:pass@h1,h2:5433,h3/db?sslmode=disable&target_session_attrs=read-write")
+	s.Nil(err)
+	s.Equal(sessionAttrsReadWrite, attrs)
+	s.Len(hosts, 3)
+	s.Equal("h1:5432", hosts[0].Addr)
+	s.Equal("h2:5433", hosts[1].Addr)
+	s.Equal("h3:5432", hosts[2].Addr)
+	for _, opts := range hosts {
+		s.Equal("user", opts.User)
+		s.Equal("pass", opts.Password)
+		s.Equal("db", opts.Database)
+		s.Nil(opts.TLSConfig)
+	}
+
+	_, attrs, err = parseMultiHostURL("postgresql://h1/db")
+	s.Nil(err)
+	s.Equal(sessionAttrsAny, attrs)
+
+	_, _, err = parseMultiHostURL("postgres://h1,h2/db?target_session_attrs=fastest")
+	s.EqualError(err, `target_session_attrs "fastest" is not supported`)
+
+	_, _, err = parseMultiHostURL("postgres://h1,,h2/db")
+	s.Contains(err.Error(), "empty host")
+
+	_, _, err = parseMultiHostURL("postgres://h1,h2/db?connect_timeout=10")
+	s.Contains(err.Error(), "not supported")
+}
+
+func (s *MultiHostTestSuite) TestReadWrite() {
+	s.stubRoles([]string{"h2:5432"}, []string{"h1:5432", "h3:5432"})
+	cluster, err := NewClusterFromURL("postgres://h1,h2,h3/db?target_session_attrs=read-write", s.newConfig())
+	s.Nil(err)
+	s.Equal("h2:5432", cluster.manager.master.host)
+	s.Equal([]string{"h1:5432", "h3:5432"}, s.slaveHosts(cluster))
+	s.Nil(cluster.Shutdown(context.Background()))
+
+	s.stubRoles(nil, []string{"h1:5432", "h3:5432"})
+	_, err = NewClusterFromURL("postgres://h1,h2,h3/db?target_session_attrs=read-write", s.newConfig())
+	s.EqualError(err, "target_session_attrs=read-write: no primary found among h1:5432, h2:5432, h3:5432")
+}
+
+func (s *MultiHostTestSuite) TestReadOnly() {
+	s.stubRoles([]string{"h1:5432"}, []string{"h2:5432"})
+	// h3 was unreachable while probing and comes back as a primary
+	standbyCheck = func(ctx context.Context, node *Node) error {
+		if node.Host == "h3:5432" {
+			return errUnhealthy
+		}
+		return nil
+	}
+	conf := s.newConfig()
+	conf.ConnCheckDelay = 10 * time.Millisecond
+	cluster, err := NewClusterFromURL("postgres://h1,h2,h3/db?target_session_attrs=read-only", conf)
+	s.Nil(err)
+	s.Nil(cluster.manager.master)
+	s.Equal([]string{"h2:5432", "h3:5432"}, s.slaveHosts(cluster))
+	s.Equal(ErrNoMasterAvailable, cluster.WriterExec("select 1;"))
+
+	// h3 answers health checks but is not in recovery, it never serves reads
+	time.Sleep(100 * time.Millisecond)
+	cluster.manager.updateActiveSlaves()
+	s.Len(cluster.manager.getActiveSlaves(), 1)
+	s.Equal("h2:5432", cluster.manager.getActiveSlaves()[0].host)
+	s.Nil(cluster.Shutdown(context.Background()))
+
+	s.stubRoles([]string{"h1:5432"}, nil)
+	_, err = NewClusterFromURL("postgres://h1,h2/db?target_session_attrs=read-only", s.newConfig())
+	s.EqualError(err, "target_session_attrs=read-only: no standby found among h1:5432, h2:5432")
+}
+
+func (s *MultiHostTestSuite) TestPreferStandby() {
+	s.stubRoles([]string{"h1:5432"}, nil)
+	cluster, err := NewClusterFromURL("postgres://h1,h2/db?target_session_attrs=prefer-standby", s.newConfig())
+	s.Nil(err)
+	s.Equal("h1:5432", cluster.manager.master.host)
+	s.Equal([]string{"h2:5432"}, s.slaveHosts(cluster))
+	s.Nil(cluster.Shutdown(context.Background()))
+}
+
+func (s *MultiHostTestSuite) TestUnreachableHostsRecover() {
+	var up int32
+	s.stubRoles([]string{"h1:5432"}, nil)
+	conf := s.newConfig()
+	conf.ConnCheckDelay = 10 * time.Millisecond
+	conf.HealthCheck = func(ctx context.Context, node *Node) error {
+		if node.Host == "h2:5432" && atomic.LoadInt32(&up) == 0 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	cluster, err := NewClusterFromURL("postgres://h1,h2/db?target_session_attrs=read-write", conf)
+	s.Nil(err)
+	defer cluster.Shutdown(context.Background())
+	s.Equal([]string{"h2:5432"}, s.slaveHosts(cluster))
+	s.Empty(cluster.manager.getActiveSlaves())
+
+	atomic.StoreInt32(&up, 1)
+	for i := 0; i < 100 && len(cluster.manager.getActiveSlaves()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		cluster.manager.updateActiveSlaves()
+	}
+	s.Len(cluster.manager.getActiveSlaves(), 1)
+}
+
+func (s *MultiHostTestSuite) TestMultiplePrimaries() {
+	s.stubRoles([]string{"h1:5432", "h2:5432"}, nil)
+	_, err := NewClusterFromURL("postgres://h1,h2/db?target_session_attrs=read-write", s.newConfig())
+	s.EqualError(err, "target_session_attrs=read-write: multiple primaries found: h1:5432, h2:5432")
+
+	// primaries are not used with read-only
+	s.stubRoles([]string{"h1:5432", "h2:5432"}, []string{"h3:5432"})
+	cluster, err := NewClusterFromURL("postgres://h1,h2,h3/db?target_session_attrs=read-only", s.newConfig())
+	s.Nil(err)
+	s.Nil(cluster.Shutdown(context.Background()))
+}
+
+func (s *MultiHostTestSuite) TestAny() {
+	s.stubRoles([]string{"h1:5432"}, []string{"h2:5432"})
+	cluster, err := NewClusterFromURL("postgres://h1,h2/db", s.newConfig())
+	s.Nil(err)
+	s.Equal("h1:5432", cluster.manager.master.host)
+	s.Equal([]string{"h2:5432", "h1:5432"}, s.slaveHosts(cluster))
+	s.Nil(cluster.Shutdown(context.Background()))
+
+	s.stubRoles(nil, nil)
+	_, err = NewClusterFromURL("postgres://h1,h2/db", s.newConfig())
+	s.EqualError(err, "target_session_attrs=any: no server reachable among h1:5432, h2:5432")
+}
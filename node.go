@@ -0,0 +1,58 @@
+package hansip
+
+// NodeOption configures a node added to the cluster.
+type NodeOption func(*nodeOptions)
+
+type nodeOptions struct {
+	weight int
+	tags   []string
+	pool   PoolConfig
+
+	serverName string
+	zone       string
+}
+
+func newNodeOptions(opts []NodeOption) *nodeOptions {
+	options := &nodeOptions{
+		weight: defaultWeight,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// sameNode tells whether o and other connect the same node, weight is left out as it can change on a running node.
+func (o *nodeOptions) sameNode(other *nodeOptions) bool {
+	if other == nil || o.pool != other.pool || o.serverName != other.serverName || o.zone != other.zone || len(o.tags) != len(other.tags) {
+		return false
+	}
+	for i := range o.tags {
+		if o.tags[i] != other.tags[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Weight sets how often a slave is picked for reads relative to other slaves.
+// Defaults to 1, a slave with weight 2 receives twice as many reads as a slave with weight 1.
+func Weight(weight int) NodeOption {
+	return func(o *nodeOptions) {
+		o.weight = weight
+	}
+}
+
+// Tags labels a node, for example "analytics" or "zone=a".
+func Tags(tags ...string) NodeOption {
+	return func(o *nodeOptions) {
+		o.tags = append(o.tags, tags...)
+	}
+}
+
+// Zone sets availability zone of a node, reads prefer slaves in Config.LocalZone.
+func Zone(zone string) NodeOption {
+	return func(o *nodeOptions) {
+		o.zone = zone
+	}
+}
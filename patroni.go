@@ -0,0 +1,138 @@
+package hansip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// PatroniDiscoverer polls /cluster endpoint of Patroni REST API.
+// The leader becomes master, running replicas become slaves.
+// In a standby cluster the standby_leader replicates from another cluster and is read only,
+// it becomes a slave along with the replicas and the cluster has no master.
+type PatroniDiscoverer struct {
+	// URL of Patroni REST API, for example "http://patroni:8008".
+	URL string
+	// Options is used to connect to every member, its Addr is replaced.
+	Options *pg.Options
+	// Interval between polls, defaults to 30 seconds.
+	Interval time.Duration
+	// MaxLag excludes replicas lagging behind more than MaxLag bytes. Zero allows any lag.
+	MaxLag int64
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+type patroniCluster struct {
+	Members []patroniMember `json:"members"`
+}
+
+type patroniMember struct {
+	Name  string      `json:"name"`
+	Role  string      `json:"role"`
+	State string      `json:"state"`
+	Host  string      `json:"host"`
+	Port  int         `json:"port"`
+	Lag   interface{} `json:"lag"`
+}
+
+// Watch implements Discoverer. Topology is sent when it differs from the previous poll,
+// failed polls are retried on next interval.
+func (p *PatroniDiscoverer) Watch(ctx context.Context) <-chan Topology {
+	topologies := make(chan Topology)
+	go func() {
+		defer close(topologies)
+
+		ticker := time.NewTicker(pollInterval(p.Interval))
+		defer ticker.Stop()
+
+		var previous *Topology
+		for {
+			if topology, err := p.fetch(ctx); err == nil && (previous == nil || !previous.sameAddrs(topology)) {
+				select {
+				case topologies <- topology:
+					previous = &topology
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return topologies
+}
+
+func (p *PatroniDiscoverer) fetch(ctx context.Context) (Topology, error) {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(p.URL, "/")+"/cluster", nil)
+	if err != nil {
+		return Topology{}, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return Topology{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Topology{}, fmt.Errorf("patroni: unexpected status %s", resp.Status)
+	}
+
+	var cluster patroniCluster
+	if err := json.NewDecoder(resp.Body).Decode(&cluster); err != nil {
+		return Topology{}, fmt.Errorf("patroni: %w", err)
+	}
+
+	var topology Topology
+	for _, member := range cluster.Members {
+		opts := p.memberOptions(member)
+		switch {
+		case member.Role == "leader" && member.State == "running":
+			topology.Master = opts
+		case member.Role == "standby_leader" && member.State == "running":
+			topology.Slaves = append(topology.Slaves, opts)
+		case member.Role == "replica" || member.Role == "sync_standby":
+			if (member.State == "running" || member.State == "streaming") && p.acceptsLag(member.Lag) {
+				topology.Slaves = append(topology.Slaves, opts)
+			}
+		}
+	}
+	return topology, nil
+}
+
+func (p *PatroniDiscoverer) memberOptions(member patroniMember) *pg.Options {
+	var opts pg.Options
+	if p.Options != nil {
+		opts = *p.Options
+	}
+	port := member.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	opts.Addr = net.JoinHostPort(member.Host, strconv.Itoa(port))
+	return &opts
+}
+
+// acceptsLag checks lag of a member, Patroni reports it in bytes or as "unknown".
+func (p *PatroniDiscoverer) acceptsLag(lag interface{}) bool {
+	if p.MaxLag <= 0 || lag == nil {
+		return true
+	}
+	bytes, ok := lag.(float64)
+	return ok && int64(bytes) <= p.MaxLag
+}
@@ -0,0 +1,135 @@
+package hansip
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// PoolConfig contains connection pool settings of a node.
+// Zero values are left to pg.Options of the node and go-pg defaults.
+type PoolConfig struct {
+	PoolSize     int
+	MinIdleConns int
+	IdleTimeout  time.Duration
+	MaxConnAge   time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// StatementTimeout is set as statement_timeout of every new connection.
+	StatementTimeout time.Duration
+}
+
+// Pool overrides cluster wide Config.Pool and pg.Options for a single node,
+// for example a large analytics replica next to small OLTP replicas.
+func Pool(pool PoolConfig) NodeOption {
+	return func(o *nodeOptions) {
+		o.pool = pool
+	}
+}
+
+// override returns a copy of p with non zero settings of other applied.
+func (p PoolConfig) override(other PoolConfig) PoolConfig {
+	if other.PoolSize != 0 {
+		p.PoolSize = other.PoolSize
+	}
+	if other.MinIdleConns != 0 {
+		p.MinIdleConns = other.MinIdleConns
+	}
+	if other.IdleTimeout != 0 {
+		p.IdleTimeout = other.IdleTimeout
+	}
+	if other.MaxConnAge != 0 {
+		p.MaxConnAge = other.MaxConnAge
+	}
+	if other.ReadTimeout != 0 {
+		p.ReadTimeout = other.ReadTimeout
+	}
+	if other.WriteTimeout != 0 {
+		p.WriteTimeout = other.WriteTimeout
+	}
+	if other.StatementTimeout != 0 {
+		p.StatementTimeout = other.StatementTimeout
+	}
+	return p
+}
+
+// nodePoolOptions merges pool settings into a copy of options.
+// Cluster wide defaults only fill settings missing from options, node overrides always win.
+func nodePoolOptions(options *pg.Options, defaults, overrides PoolConfig) *pg.Options {
+	opts := *options
+
+	pool := PoolConfig{
+		PoolSize:     opts.PoolSize,
+		MinIdleConns: opts.MinIdleConns,
+		IdleTimeout:  opts.IdleTimeout,
+		MaxConnAge:   opts.MaxConnAge,
+		ReadTimeout:  opts.ReadTimeout,
+		WriteTimeout: opts.WriteTimeout,
+	}
+	pool = defaults.override(pool).override(overrides)
+
+	opts.PoolSize = pool.PoolSize
+	opts.MinIdleConns = pool.MinIdleConns
+	opts.IdleTimeout = pool.IdleTimeout
+	opts.MaxConnAge = pool.MaxConnAge
+	opts.ReadTimeout = pool.ReadTimeout
+	opts.WriteTimeout = pool.WriteTimeout
+
+	if timeout := pool.StatementTimeout; timeout > 0 {
+		onConnect := opts.OnConnect
+		opts.OnConnect = func(conn *pg.Conn) error {
+			query := fmt.Sprintf("set statement_timeout = %d;", timeout/time.Millisecond)
+			if _, err := conn.Exec(query); err != nil {
+				return err
+			}
+			if onConnect != nil {
+				return onConnect(conn)
+			}
+			return nil
+		}
+	}
+	return &opts
+}
+
+// FilePoolConfig is PoolConfig written in a config file.
+type FilePoolConfig struct {
+	PoolSize         int      `json:"pool_size" yaml:"pool_size" toml:"pool_size"`
+	MinIdleConns     int      `json:"min_idle_conns" yaml:"min_idle_conns" toml:"min_idle_conns"`
+	IdleTimeout      Duration `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`
+	MaxConnAge       Duration `json:"max_conn_age" yaml:"max_conn_age" toml:"max_conn_age"`
+	ReadTimeout      Duration `json:"read_timeout" yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout     Duration `json:"write_timeout" yaml:"write_timeout" toml:"write_timeout"`
+	StatementTimeout Duration `json:"statement_timeout" yaml:"statement_timeout" toml:"statement_timeout"`
+}
+
+// PoolConfig converts f to PoolConfig.
+func (f *FilePoolConfig) PoolConfig() PoolConfig {
+	if f == nil {
+		return PoolConfig{}
+	}
+	return PoolConfig{
+		PoolSize:         f.PoolSize,
+		MinIdleConns:     f.MinIdleConns,
+		IdleTimeout:      time.Duration(f.IdleTimeout),
+		MaxConnAge:       time.Duration(f.MaxConnAge),
+		ReadTimeout:      time.Duration(f.ReadTimeout),
+		WriteTimeout:     time.Duration(f.WriteTimeout),
+		StatementTimeout: time.Duration(f.StatementTimeout),
+	}
+}
+
+func (f *FilePoolConfig) validate() error {
+	if f == nil {
+		return nil
+	}
+	if f.PoolSize < 0 || f.MinIdleConns < 0 {
+		return fmt.Errorf("pool_size and min_idle_conns must not be negative")
+	}
+	for _, d := range []Duration{f.IdleTimeout, f.MaxConnAge, f.ReadTimeout, f.WriteTimeout, f.StatementTimeout} {
+		if d < 0 {
+			return fmt.Errorf("pool timeouts must not be negative, got %s", time.Duration(d))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package hansip
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/stretchr/testify/suite"
+)
+
+type PoolTestSuite struct {
+	TestSuite
+}
+
+func TestPool(t *testing.T) {
+	s := &PoolTestSuite{}
+	s.noCreateCluster = true
+	suite.Run(t, s)
+}
+
+func (s *PoolTestSuite) TestNodePoolOptions() {
+	options := &pg.Options{
+		Addr:        "analytics:5432",
+		PoolSize:    5,
+		ReadTimeout: 1 * time.Second,
+	}
+	defaults := PoolConfig{
+		PoolSize:     20,
+		MinIdleConns: 2,
+		IdleTimeout:  1 * time.Minute,
+		ReadTimeout:  10 * time.Second,
+	}
+
+	// defaults only fill missing settings
+	opts := nodePoolOptions(options, defaults, PoolConfig{})
+	s.Equal(5, opts.PoolSize)
+	s.Equal(2, opts.MinIdleConns)
+	s.Equal(1*time.Minute, opts.IdleTimeout)
+	s.Equal(1*time.Second, opts.ReadTimeout)
+	s.Nil(opts.OnConnect)
+
+	// node overrides always win
+	opts = nodePoolOptions(options, defaults, PoolConfig{
+		PoolSize:         50,
+		ReadTimeout:      5 * time.Minute,
+		StatementTimeout: 10 * time.Minute,
+	})
+	s.Equal(50, opts.PoolSize)
+	s.Equal(2, opts.MinIdleConns)
+	s.Equal(5*time.Minute, opts.ReadTimeout)
+	s.NotNil(opts.OnConnect)
+
+	// given options are left untouched
+	s.Equal(5, options.PoolSize)
+	s.Equal(0, options.MinIdleConns)
+	s.Nil(options.OnConnect)
+}
+
+func (s *PoolTestSuite) TestPoolFromConfig() {
+	cc := &ClusterConfig{
+		Master: NodeConfig{URL: "postgres://app@127.0.0.1:1/db"},
+		Slaves: []NodeConfig{
+			{URL: "postgres://app@127.0.0.1:2/db", Pool: &FilePoolConfig{PoolSize: 50}},
+		},
+		Pool: &FilePoolConfig{
+			PoolSize:         10,
+			IdleTimeout:      Duration(1 * time.Minute),
+			StatementTimeout: Duration(30 * time.Second),
+		},
+		LazyConnect: true,
+	}
+	cluster, err := NewClusterFromConfig(cc)
+	s.Nil(err)
+	defer cluster.Shutdown(context.Background())
+
+	s.Equal(30*time.Second, cluster.getConfig().Pool.StatementTimeout)
+	master := cluster.manager.getMaster().s.(*gopgSQL).getDB().Options()
+	s.Equal(10, master.PoolSize)
+	s.Equal(1*time.Minute, master.IdleTimeout)
+	slave := cluster.manager.getSlaves()[0].s.(*gopgSQL).getDB().Options()
+	s.Equal(50, slave.PoolSize)
+	s.Equal(1*time.Minute, slave.IdleTimeout)
+
+	cc.Pool.MinIdleConns = -1
+	s.EqualError(cc.Validate(), "pool: pool_size and min_idle_conns must not be negative")
+}
+
+func (s *PoolTestSuite) TestStatementTimeout() {
+	cluster := NewCluster(&Config{
+		Pool: PoolConfig{StatementTimeout: 1500 * time.Millisecond},
+	})
+	defer cluster.Shutdown(context.Background())
+	s.Nil(cluster.SetMaster(s.getMasterConnectionInfo()))
+
+	var timeout string
+	s.Nil(cluster.WriterQuery(pg.Scan(&timeout), "show statement_timeout;"))
+	s.Equal("1500ms", timeout)
+}
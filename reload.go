@@ -0,0 +1,89 @@
+package hansip
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Reload applies cc to a running cluster.
+// Timings are applied to running connections right away and nodes from ClusterConfig are reconciled:
+// master is replaced when its url changes, slaves are added or removed and their weights are updated.
+// A node whose pool, server_name or zone changes is connected again and replaces its previous connection.
+// Cluster wide pool and tls sections are kept when cc does not have them and apply to nodes connected afterwards.
+// Slaves added with AddSlave or by discovery are left untouched.
+// Settings which can not be written in ClusterConfig, such as HealthCheck, are kept.
+func (c *Cluster) Reload(cc *ClusterConfig) error {
+	if err := cc.Validate(); err != nil {
+		return err
+	}
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	defer c.release()
+
+	conf := *c.getConfig()
+	cc.applyTo(&conf)
+	conf.setDefaults()
+	c.setConfig(&conf)
+
+	c.manager.setConnCheckDelay(conf.ConnCheckDelay)
+	c.manager.setLocality(conf.LocalZone, conf.SaturationThreshold)
+	if master := c.manager.getMaster(); master != nil {
+		master.applyConfig(&conf)
+	}
+	for _, conn := range c.manager.getSlaves() {
+		conn.applyConfig(&conf)
+	}
+
+	return c.applyNodes(cc)
+}
+
+// WatchConfigFile reloads the cluster from given file when its content changes or the process receives SIGHUP.
+// The file is checked every interval, 30 seconds when not positive. Errors from loading or applying the file are passed to onError when it is not nil.
+// Watching stops when ctx is done or the cluster is shut down.
+func (c *Cluster) WatchConfigFile(ctx context.Context, path string, interval time.Duration, onError func(error)) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	// the cluster is usually created from the same file, so current content is not reloaded
+	previous, _ := ioutil.ReadFile(path)
+
+	reload := func() {
+		cc, err := LoadConfigFile(path)
+		if err == nil {
+			err = c.Reload(cc)
+		}
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+
+	go func() {
+		defer signal.Stop(sighup)
+
+		ticker := time.NewTicker(pollInterval(interval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				content, err := ioutil.ReadFile(path)
+				if err != nil || bytes.Equal(content, previous) {
+					continue
+				}
+				previous = content
+				reload()
+			case <-sighup:
+				reload()
+			case <-ctx.Done():
+				return
+			case <-c.quitChan:
+				return
+			}
+		}
+	}()
+}
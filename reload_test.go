@@ -0,0 +1,230 @@
+package hansip
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/stretchr/testify/suite"
+)
+
+type ReloadTestSuite struct {
+	suite.Suite
+	cluster *Cluster
+	pings   int32
+	dir     string
+}
+
+func TestReload(t *testing.T) {
+	s := &ReloadTestSuite{}
+	suite.Run(t, s)
+}
+
+func (s *ReloadTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "hansip")
+	s.Nil(err)
+	s.dir = dir
+
+	atomic.StoreInt32(&s.pings, 0)
+	conf := s.clusterConfig([]NodeConfig{
+		{URL: "postgres://app@slave1:5432/db", Weight: 1},
+		{URL: "postgres://app@slave2:5432/db"},
+	})
+	s.cluster = NewCluster(conf.Config())
+	s.cluster.conf.HealthCheck = func(ctx context.Context, node *Node) error {
+		atomic.AddInt32(&s.pings, 1)
+		return nil
+	}
+	s.Nil(s.cluster.applyNodes(conf))
+}
+
+func (s *ReloadTestSuite) TearDownTest() {
+	s.Nil(s.cluster.Shutdown(context.Background()))
+	os.RemoveAll(s.dir)
+}
+
+func (s *ReloadTestSuite) clusterConfig(slaves []NodeConfig) *ClusterConfig {
+	return &ClusterConfig{
+		Master:         NodeConfig{URL: "postgres://app@master:5432/db"},
+		Slaves:         slaves,
+		ConnCheckDelay: Duration(1 * time.Hour),
+	}
+}
+
+func (s *ReloadTestSuite) slaves() map[string]*connection {
+	slaves := map[string]*connection{}
+	for _, conn := range s.cluster.manager.getSlaves() {
+		slaves[conn.host] = conn
+	}
+	return slaves
+}
+
+func (s *ReloadTestSuite) slaveHosts() []string {
+	var hosts []string
+	for host := range s.slaves() {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func (s *ReloadTestSuite) TestReloadTimings() {
+	master := s.cluster.manager.getMaster()
+	pings := atomic.LoadInt32(&s.pings)
+	time.Sleep(200 * time.Millisecond)
+	s.Equal(pings, atomic.LoadInt32(&s.pings))
+
+	cc := s.clusterConfig(nil)
+	cc.ConnCheckDelay = Duration(50 * time.Millisecond)
+	cc.ConnPingTimeout = Duration(2 * time.Second)
+	cc.FailureThreshold = 3
+	s.Nil(s.cluster.Reload(cc))
+
+	s.Equal(50*time.Millisecond, s.cluster.getConfig().ConnCheckDelay)
+	s.NotNil(s.cluster.getConfig().HealthCheck)
+	s.Equal(50*time.Millisecond, s.cluster.manager.getConnCheckDelay())
+	master.settingsMutex.RLock()
+	s.Equal(2*time.Second, master.pingTimeout)
+	s.Equal(3, master.failureThreshold)
+	master.settingsMutex.RUnlock()
+
+	// running loops pick new delay up without waiting for the old one
+	time.Sleep(300 * time.Millisecond)
+	s.True(atomic.LoadInt32(&s.pings) > pings+2)
+	s.True(master == s.cluster.manager.getMaster())
+}
+
+func (s *ReloadTestSuite) TestReloadNodes() {
+	s.Nil(s.cluster.AddSlave(s.mustParse("postgres://app@manual:5432/db")))
+	slave1 := s.slaves()["slave1:5432"]
+
+	s.Nil(s.cluster.Reload(s.clusterConfig([]NodeConfig{
+		{URL: "postgres://app@slave1:5432/db", Weight: 5},
+		{URL: "postgres://app@slave3:5432/db"},
+	})))
+	s.Equal([]string{"manual:5432", "slave1:5432", "slave3:5432"}, s.slaveHosts())
+	s.True(slave1 == s.slaves()["slave1:5432"])
+	s.Equal(5, slave1.getWeight())
+	s.Equal("master:5432", s.cluster.manager.getMaster().host)
+
+	previous := s.cluster.manager.getMaster()
+	cc := s.clusterConfig(nil)
+	cc.Master.URL = "postgres://app@new-master:5432/db"
+	s.Nil(s.cluster.Reload(cc))
+	s.Equal([]string{"manual:5432"}, s.slaveHosts())
+	s.Equal("new-master:5432", s.cluster.manager.getMaster().host)
+	s.True(previous.closed)
+
+	s.EqualError(s.cluster.Reload(&ClusterConfig{}), "master: url is required")
+}
+
+func (s *ReloadTestSuite) TestReloadNodeOptions() {
+	slave1, slave2 := s.slaves()["slave1:5432"], s.slaves()["slave2:5432"]
+	master := s.cluster.manager.getMaster()
+
+	// zone is fixed once a node connects, changing it connects the node again
+	cc := s.clusterConfig([]NodeConfig{
+		{URL: "postgres://app@slave1:5432/db", Weight: 1, Zone: "b"},
+		{URL: "postgres://app@slave2:5432/db", Weight: 3},
+	})
+	cc.Master.Zone = "a"
+	s.Nil(s.cluster.Reload(cc))
+	s.Equal([]string{"slave1:5432", "slave2:5432"}, s.slaveHosts())
+	s.False(slave1 == s.slaves()["slave1:5432"])
+	s.Equal("b", s.slaves()["slave1:5432"].zone)
+	s.True(slave1.closed)
+	s.True(slave2 == s.slaves()["slave2:5432"])
+	s.Equal(3, slave2.getWeight())
+	s.False(master == s.cluster.manager.getMaster())
+	s.Equal("a", s.cluster.manager.getMaster().zone)
+	s.True(master.closed)
+
+	// nothing changed, nodes are kept
+	master, slave1 = s.cluster.manager.getMaster(), s.slaves()["slave1:5432"]
+	s.Nil(s.cluster.Reload(cc))
+	s.True(master == s.cluster.manager.getMaster())
+	s.True(slave1 == s.slaves()["slave1:5432"])
+}
+
+func (s *ReloadTestSuite) TestReloadKeepsMissingSections() {
+	cc := s.clusterConfig(nil)
+	cc.Pool = &FilePoolConfig{PoolSize: 7}
+	cc.TLS = &FileTLSConfig{InsecureSkipVerify: true}
+	s.Nil(s.cluster.Reload(cc))
+	s.Equal(7, s.cluster.getConfig().Pool.PoolSize)
+	s.NotNil(s.cluster.getConfig().TLS)
+
+	// a file without pool and tls sections keeps them
+	s.Nil(s.cluster.Reload(s.clusterConfig(nil)))
+	s.Equal(7, s.cluster.getConfig().Pool.PoolSize)
+	s.NotNil(s.cluster.getConfig().TLS)
+}
+
+func (s *ReloadTestSuite) TestWatchConfigFile() {
+	path := filepath.Join(s.dir, "hansip.yaml")
+	s.Nil(ioutil.WriteFile(path, []byte(`
+master:
+  url: postgres://app@master:5432/db
+slaves:
+  - url: postgres://app@slave1:5432/db
+  - url: postgres://app@slave2:5432/db
+conn_check_delay: 1h
+`), 0600))
+
+	errs := make(chan error, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.cluster.WatchConfigFile(ctx, path, 50*time.Millisecond, func(err error) {
+		errs <- err
+	})
+
+	s.Nil(ioutil.WriteFile(path, []byte(`
+master:
+  url: postgres://app@master:5432/db
+slaves:
+  - url: postgres://app@slave2:5432/db
+conn_check_delay: 1h
+`), 0600))
+	time.Sleep(200 * time.Millisecond)
+	s.Equal([]string{"slave2:5432"}, s.slaveHosts())
+
+	s.Nil(ioutil.WriteFile(path, []byte(`master: {}`), 0600))
+	select {
+	case err := <-errs:
+		s.EqualError(err, "master: url is required")
+	case <-time.After(1 * time.Second):
+		s.Fail("error is not reported")
+	}
+}
+
+func (s *ReloadTestSuite) TestWatchConfigFileOnSIGHUP() {
+	path := filepath.Join(s.dir, "hansip.json")
+	s.Nil(ioutil.WriteFile(path, []byte(`{
+		"master": {"url": "postgres://app@master:5432/db"},
+		"conn_check_delay": "1h"
+	}`), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// zero interval falls back to the default instead of panicking
+	s.cluster.WatchConfigFile(ctx, path, 0, nil)
+
+	process, err := os.FindProcess(os.Getpid())
+	s.Nil(err)
+	s.Nil(process.Signal(syscall.SIGHUP))
+	time.Sleep(200 * time.Millisecond)
+	s.Empty(s.slaveHosts())
+}
+
+func (s *ReloadTestSuite) mustParse(url string) *pg.Options {
+	opts, err := pg.ParseURL(url)
+	s.Nil(err)
+	return opts
+}
@@ -0,0 +1,107 @@
+package hansip
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// number of points each unit of weight puts on the ring,
+// more points spread keys more evenly among slaves
+const ringVirtualNodes = 100
+
+// hashRing places slaves on a consistent hash ring, so only keys of a joining or leaving slave move.
+type hashRing struct {
+	points []uint64
+	conns  []*connection
+}
+
+type ringPoint struct {
+	hash uint64
+	conn *connection
+}
+
+func newHashRing(conns []*connection) *hashRing {
+	var points []ringPoint
+	for _, conn := range conns {
+		for i := 0; i < ringVirtualNodes*weightOf(conn); i++ {
+			points = append(points, ringPoint{
+				hash: hashKey(conn.host + "#" + strconv.Itoa(i)),
+				conn: conn,
+			})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+
+	ring := &hashRing{
+		points: make([]uint64, len(points)),
+		conns:  make([]*connection, len(points)),
+	}
+	for i, point := range points {
+		ring.points[i] = point.hash
+		ring.conns[i] = point.conn
+	}
+	return ring
+}
+
+// get returns the first slave accepted by match clockwise from key, nil match accepts every slave.
+func (r *hashRing) get(key string, match func(conn *connection) bool) *connection {
+	if r == nil || len(r.points) == 0 {
+		return nil
+	}
+	hash := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= hash
+	})
+	for i := 0; i < len(r.points); i++ {
+		conn := r.conns[(start+i)%len(r.points)]
+		if match == nil || match(conn) {
+			return conn
+		}
+	}
+	return nil
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	// fnv alone clusters similar keys such as "host#1" and "host#2", mix bits like murmur3 finalizer
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// QueryByKey runs query on the slave owning key on a consistent hash ring of active slaves,
+// so reads of the same key hit the same buffer cache. Only a small share of keys moves when slaves join or leave.
+// Slaves with Config.ReservedTags are skipped and master is used when no slave is available.
+func (c *Cluster) QueryByKey(ctx context.Context, key string, dest interface{}, query string, args ...interface{}) error {
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	defer c.release()
+
+	reserved := c.getConfig().ReservedTags
+	pick := func() (*connection, error) {
+		conn := c.manager.getRing().get(key, func(conn *connection) bool {
+			return !hasAnyTag(conn.tags, reserved)
+		})
+		if conn == nil {
+			conn = c.manager.writerConnection()
+		}
+		if conn == nil {
+			return nil, ErrNoSlaveAvailable
+		}
+		return conn, nil
+	}
+	return onConnection(pick, func(conn *connection) error {
+		return conn.query(ctx, dest, query, args...)
+	})
+}
@@ -0,0 +1,90 @@
+package hansip
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RingTestSuite struct {
+	suite.Suite
+}
+
+func TestRing(t *testing.T) {
+	s := &RingTestSuite{}
+	suite.Run(t, s)
+}
+
+func (s *RingTestSuite) owners(manager *connectionManager, keys int) map[string]*connection {
+	owners := map[string]*connection{}
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		owners[key] = manager.getRing().get(key, nil)
+	}
+	return owners
+}
+
+func (s *RingTestSuite) TestMinimalMovement() {
+	a, b, c := newDummySlave("a:5432", ""), newDummySlave("b:5432", ""), newDummySlave("c:5432", "")
+	manager := &connectionManager{}
+	manager.addSlave(a)
+	manager.addSlave(b)
+	before := s.owners(manager, 1000)
+
+	// keys only move to the joining slave
+	manager.addSlave(c)
+	after := s.owners(manager, 1000)
+	moved := 0
+	for key, owner := range after {
+		if owner != before[key] {
+			s.True(owner == c)
+			moved++
+		}
+	}
+	s.InDelta(333, moved, 100)
+
+	// keys of the leaving slave move, others stay
+	c.setConnected(false)
+	manager.updateActiveSlaves()
+	for key, owner := range s.owners(manager, 1000) {
+		if after[key] != c {
+			s.True(owner == after[key])
+		}
+	}
+}
+
+func (s *RingTestSuite) TestWeight() {
+	a, b := newDummySlave("a:5432", ""), newDummySlave("b:5432", "")
+	b.weight = 3
+	manager := &connectionManager{}
+	manager.addSlave(a)
+	manager.addSlave(b)
+
+	count := 0
+	for _, owner := range s.owners(manager, 1000) {
+		if owner == b {
+			count++
+		}
+	}
+	s.InDelta(750, count, 100)
+}
+
+func (s *RingTestSuite) TestQueryByKey() {
+	a, delayed := newDummySlave("a:5432", ""), newDummySlave("delayed:5432", "")
+	delayed.tags = []string{"delayed"}
+	cluster, master := newDummyCluster(&Config{ReservedTags: []string{"delayed"}}, a, delayed)
+
+	for i := 0; i < 20; i++ {
+		s.Nil(cluster.QueryByKey(context.Background(), fmt.Sprintf("user-%d", i), nil, "select 1;"))
+	}
+	s.True(a.s.(*dummySQL).queryRun)
+	s.False(delayed.s.(*dummySQL).queryRun)
+
+	a.setConnected(false)
+	cluster.manager.updateActiveSlaves()
+	s.Nil(cluster.QueryByKey(context.Background(), "user-1", nil, "select 1;"))
+	s.True(master.queryRun)
+	s.False(delayed.s.(*dummySQL).queryRun)
+}
@@ -0,0 +1,95 @@
+package hansip
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+type roleKey struct{}
+
+type settingsKey struct{}
+
+type localSetting struct {
+	name  string
+	value string
+}
+
+// WithRole returns a copy of ctx which runs queries as role, for example to apply row level security policies.
+// Queries run in an implicit transaction starting with SET LOCAL ROLE, transactions run it right after BEGIN,
+// so the role never outlives the query or transaction on a pooled connection.
+func WithRole(ctx context.Context, role string) context.Context {
+	return context.WithValue(ctx, roleKey{}, role)
+}
+
+// WithSetting returns a copy of ctx which sets configuration parameter name, such as "app.user_id",
+// with set_config(name, value, true). It is scoped like WithRole and can be given multiple times.
+func WithSetting(ctx context.Context, name, value string) context.Context {
+	previous, _ := ctx.Value(settingsKey{}).([]localSetting)
+	settings := make([]localSetting, len(previous), len(previous)+1)
+	copy(settings, previous)
+	settings = append(settings, localSetting{name: name, value: value})
+	return context.WithValue(ctx, settingsKey{}, settings)
+}
+
+// hasLocalSettings tells whether queries of ctx need an implicit transaction.
+func hasLocalSettings(ctx context.Context) bool {
+	if _, ok := ctx.Value(roleKey{}).(string); ok {
+		return true
+	}
+	settings, _ := ctx.Value(settingsKey{}).([]localSetting)
+	return len(settings) > 0
+}
+
+// localSettings lists statements applying tenant, role, statement timeout and settings of ctx
+// until the transaction they run in ends.
+func localSettings(ctx context.Context) []batchStatement {
+	var statements []batchStatement
+	if schema, ok := tenantFromContext(ctx); ok {
+		statements = append(statements, batchStatement{query: "set local search_path = ?, public;", args: []interface{}{pg.F(schema)}})
+	}
+	if role, ok := ctx.Value(roleKey{}).(string); ok {
+		statements = append(statements, batchStatement{query: "set local role ?;", args: []interface{}{pg.F(role)}})
+	}
+	if timeout, ok := statementTimeoutFromContext(ctx); ok && timeout > 0 {
+		statements = append(statements, batchStatement{query: "set local statement_timeout = ?;", args: []interface{}{int64(timeout / time.Millisecond)}})
+	}
+	settings, _ := ctx.Value(settingsKey{}).([]localSetting)
+	for _, setting := range settings {
+		statements = append(statements, batchStatement{query: "select set_config(?, ?, true);", args: []interface{}{setting.name, setting.value}})
+	}
+	return statements
+}
+
+// applyLocalSettings applies tenant, role, statement timeout and settings of ctx until tx ends.
+func applyLocalSettings(ctx context.Context, tx *pg.Tx) error {
+	for _, setting := range localSettings(ctx) {
+		if _, err := tx.ExecContext(ctx, setting.query, setting.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runScoped runs fn with tenant, role and settings of ctx applied.
+// Role and settings need a transaction to be reverted reliably, a tenant alone uses a pinned connection.
+func runScoped(ctx context.Context, db *pg.DB, fn func(q gopgQuerier) error) error {
+	if !hasLocalSettings(ctx) {
+		return runAsTenant(ctx, db, fn)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := applyLocalSettings(ctx, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,79 @@
+package hansip
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/go-pg/pg"
+	"github.com/stretchr/testify/suite"
+)
+
+type RoleTestSuite struct {
+	TestSuite
+}
+
+func TestRole(t *testing.T) {
+	s := &RoleTestSuite{}
+	s.noCreateCluster = true
+	suite.Run(t, s)
+}
+
+func (s *RoleTestSuite) TestContext() {
+	s.False(hasLocalSettings(context.Background()))
+	s.True(hasLocalSettings(WithRole(context.Background(), "app_user")))
+
+	// settings added later do not leak into contexts derived earlier
+	base := WithSetting(context.Background(), "app.user_id", "1")
+	first := WithSetting(base, "app.tenant_id", "a")
+	second := WithSetting(base, "app.tenant_id", "b")
+	s.Equal([]localSetting{{"app.user_id", "1"}, {"app.tenant_id", "a"}}, first.Value(settingsKey{}))
+	s.Equal([]localSetting{{"app.user_id", "1"}, {"app.tenant_id", "b"}}, second.Value(settingsKey{}))
+}
+
+func (s *RoleTestSuite) TestRoleAndSettingsDoNotLeak() {
+	cluster := NewCluster(&Config{Pool: PoolConfig{PoolSize: 2}})
+	defer cluster.Shutdown(context.Background())
+	s.Nil(cluster.SetMaster(s.getMasterConnectionInfo()))
+
+	s.Nil(cluster.WriterExec("drop role if exists hansip_rls_user;"))
+	s.Nil(cluster.WriterExec("create role hansip_rls_user;"))
+	defer cluster.WriterExec("drop role hansip_rls_user;")
+	var loginUser string
+	s.Nil(cluster.WriterQuery(pg.Scan(&loginUser), "select current_user;"))
+	s.Nil(cluster.WriterExec("grant hansip_rls_user to " + loginUser + ";"))
+
+	ctx := WithSetting(WithRole(context.Background(), "hansip_rls_user"), "app.user_id", "42")
+
+	var user, userID string
+	s.Nil(cluster.WriterQueryContext(ctx, pg.Scan(&user, &userID), "select current_user, current_setting('app.user_id');"))
+	s.Equal("hansip_rls_user", user)
+	s.Equal("42", userID)
+
+	// failed queries roll the implicit transaction back
+	s.NotNil(cluster.WriterExecContext(ctx, "select 1/0;"))
+
+	tx, err := cluster.NewTransactionContext(ctx)
+	s.Nil(err)
+	s.Nil(tx.Query(pg.Scan(&user, &userID), "select current_user, current_setting('app.user_id');"))
+	s.Equal("hansip_rls_user", user)
+	s.Equal("42", userID)
+	s.Nil(tx.Commit())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			cluster.WriterExecContext(ctx, "select 1;")
+		}()
+		go func() {
+			defer wg.Done()
+			var user, userID string
+			s.Nil(cluster.WriterQuery(pg.Scan(&user, &userID), "select current_user, coalesce(current_setting('app.user_id', true), '');"))
+			s.Equal(loginUser, user)
+			s.Equal("", userID)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,135 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNoTaggedSlaveAvailable is returned when no healthy slave has tags of a route with FallbackNone.
+var ErrNoTaggedSlaveAvailable = errors.New("no slave with requested tags available")
+
+// Fallback decides where a query goes when no healthy slave has the tags of its route.
+type Fallback int
+
+// fallback rules of Route
+const (
+	// FallbackAnySlave runs the query on any slave without reserved tags, then on master.
+	FallbackAnySlave Fallback = iota
+	// FallbackMaster runs the query on master.
+	FallbackMaster
+	// FallbackNone fails the query with ErrNoTaggedSlaveAvailable.
+	FallbackNone
+)
+
+// Route selects slaves which serve a query.
+type Route struct {
+	// Tags lists tags a slave must have, all of them.
+	Tags     []string
+	Fallback Fallback
+}
+
+type routeKey struct{}
+
+// WithRoute returns a copy of ctx which makes QueryContext run on slaves selected by route.
+func WithRoute(ctx context.Context, route Route) context.Context {
+	return context.WithValue(ctx, routeKey{}, &route)
+}
+
+// WithTags returns a copy of ctx which makes QueryContext run on slaves having all tags,
+// falling back to any slave and then to master.
+func WithTags(ctx context.Context, tags ...string) context.Context {
+	return WithRoute(ctx, Route{Tags: tags})
+}
+
+func routeFromContext(ctx context.Context) *Route {
+	route, _ := ctx.Value(routeKey{}).(*Route)
+	return route
+}
+
+// QueryContext runs query like Query, on slaves selected by route of ctx when it has one.
+// With a session in ctx, see WithSession, the query runs on the slave pinned to the session.
+// Slaves with Config.ReservedTags only serve queries whose route targets them.
+// The query is cancelled when ctx is done.
+func (c *Cluster) QueryContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	defer c.release()
+
+	return onConnection(func() (*connection, error) {
+		return c.reader(ctx)
+	}, func(conn *connection) error {
+		return conn.query(ctx, dest, query, args...)
+	})
+}
+
+// QueryOn runs query on slaves tagged with tag, see WithTags for fallback.
+func (c *Cluster) QueryOn(tag string, dest interface{}, query string, args ...interface{}) error {
+	return c.QueryContext(WithTags(context.Background(), tag), dest, query, args...)
+}
+
+// reader picks connection for a read query following session and route of ctx.
+func (c *Cluster) reader(ctx context.Context) (*connection, error) {
+	if session := sessionFromContext(ctx); session != nil {
+		return session.pick(c.manager, func() (*connection, error) {
+			return c.pickReader(ctx)
+		})
+	}
+	return c.pickReader(ctx)
+}
+
+func (c *Cluster) pickReader(ctx context.Context) (*connection, error) {
+	reserved := c.getConfig().ReservedTags
+	unreserved := func(conn *connection) bool {
+		return !hasAnyTag(conn.tags, reserved)
+	}
+
+	fallback := FallbackAnySlave
+	// a route without tags targets no reserved slave
+	if route := routeFromContext(ctx); route != nil {
+		match := unreserved
+		if len(route.Tags) > 0 {
+			match = func(conn *connection) bool {
+				return hasAllTags(conn.tags, route.Tags)
+			}
+		}
+		conn := c.manager.pickReader(match)
+		if conn != nil {
+			return conn, nil
+		}
+		fallback = route.Fallback
+	}
+
+	switch fallback {
+	case FallbackNone:
+		return nil, ErrNoTaggedSlaveAvailable
+	case FallbackAnySlave:
+		if conn := c.manager.pickReader(unreserved); conn != nil {
+			return conn, nil
+		}
+	}
+	if conn := c.manager.writerConnection(); conn != nil {
+		return conn, nil
+	}
+	return nil, ErrNoSlaveAvailable
+}
+
+func hasAllTags(tags, wanted []string) bool {
+	for _, w := range wanted {
+		if !hasAnyTag(tags, []string{w}) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasAnyTag(tags, wanted []string) bool {
+	for _, tag := range tags {
+		for _, w := range wanted {
+			if tag == w {
+				return true
+			}
+		}
+	}
+	return false
+}
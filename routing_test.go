@@ -0,0 +1,92 @@
+package hansip
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RoutingTestSuite struct {
+	suite.Suite
+}
+
+func TestRouting(t *testing.T) {
+	s := &RoutingTestSuite{}
+	suite.Run(t, s)
+}
+
+func (s *RoutingTestSuite) TestQueryOn() {
+	oltp := newDummySlave("", "", "zone=a")
+	oltpSQL := oltp.s.(*dummySQL)
+	analytics := newDummySlave("", "", "analytics", "zone=b")
+	analyticsSQL := analytics.s.(*dummySQL)
+	cluster, _ := newDummyCluster(&Config{}, oltp, analytics)
+
+	s.Nil(cluster.QueryOn("analytics", nil, "select 1;"))
+	s.True(analyticsSQL.queryRun)
+	s.False(oltpSQL.queryRun)
+
+	analyticsSQL.queryRun = false
+	ctx := WithTags(context.Background(), "analytics", "zone=b")
+	s.Nil(cluster.QueryContext(ctx, nil, "select 1;"))
+	s.True(analyticsSQL.queryRun)
+	s.False(oltpSQL.queryRun)
+}
+
+func (s *RoutingTestSuite) TestReservedTags() {
+	oltp := newDummySlave("", "")
+	oltpSQL := oltp.s.(*dummySQL)
+	delayed := newDummySlave("", "", "delayed")
+	delayedSQL := delayed.s.(*dummySQL)
+	cluster, master := newDummyCluster(&Config{ReservedTags: []string{"delayed"}}, oltp, delayed)
+
+	for i := 0; i < 20; i++ {
+		s.Nil(cluster.Query(nil, "select 1;"))
+	}
+	s.True(oltpSQL.queryRun)
+	s.False(delayedSQL.queryRun)
+
+	// reserved slaves are not used even when other slaves are down
+	oltp.setConnected(false)
+	cluster.manager.updateActiveSlaves()
+	s.Nil(cluster.Query(nil, "select 1;"))
+	s.True(master.queryRun)
+	s.False(delayedSQL.queryRun)
+
+	// routes without tags do not target reserved slaves either
+	s.Nil(cluster.QueryContext(WithTags(context.Background()), nil, "select 1;"))
+	s.Nil(cluster.QueryContext(WithRoute(context.Background(), Route{}), nil, "select 1;"))
+	s.False(delayedSQL.queryRun)
+
+	s.Nil(cluster.QueryOn("delayed", nil, "select 1;"))
+	s.True(delayedSQL.queryRun)
+}
+
+func (s *RoutingTestSuite) TestFallback() {
+	oltp := newDummySlave("", "")
+	oltpSQL := oltp.s.(*dummySQL)
+	analytics := newDummySlave("", "", "analytics")
+	analyticsSQL := analytics.s.(*dummySQL)
+	analytics.setConnected(false)
+	cluster, master := newDummyCluster(&Config{}, oltp, analytics)
+
+	s.Nil(cluster.QueryOn("analytics", nil, "select 1;"))
+	s.True(oltpSQL.queryRun)
+	s.False(master.queryRun)
+
+	ctx := WithRoute(context.Background(), Route{Tags: []string{"analytics"}, Fallback: FallbackMaster})
+	s.Nil(cluster.QueryContext(ctx, nil, "select 1;"))
+	s.True(master.queryRun)
+
+	ctx = WithRoute(context.Background(), Route{Tags: []string{"analytics"}, Fallback: FallbackNone})
+	s.Equal(ErrNoTaggedSlaveAvailable, cluster.QueryContext(ctx, nil, "select 1;"))
+	s.False(analyticsSQL.queryRun)
+
+	// any slave falls back to master as last resort
+	oltp.setConnected(false)
+	cluster.manager.updateActiveSlaves()
+	master.queryRun = false
+	s.Nil(cluster.QueryOn("analytics", nil, "select 1;"))
+	s.True(master.queryRun)
+}
@@ -0,0 +1,65 @@
+package hansip
+
+import (
+	"context"
+	"sync"
+)
+
+// Session pins reads to one slave for its lifetime, so a paginated listing does not see rows
+// jumping back and forth between replicas lagging by different amounts.
+// The session picks another slave only when its slave leaves active slaves.
+// Reads falling back to master are not pinned. A Session is safe for concurrent use.
+type Session struct {
+	cluster *Cluster
+
+	mutex sync.Mutex
+	conn  *connection
+}
+
+// Session creates a new reader session.
+func (c *Cluster) Session() *Session {
+	return &Session{cluster: c}
+}
+
+type sessionKey struct{}
+
+// WithSession returns a copy of ctx which makes QueryContext read through session.
+func WithSession(ctx context.Context, session *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+func sessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionKey{}).(*Session)
+	return session
+}
+
+// Query runs query on the slave pinned to the session.
+func (s *Session) Query(dest interface{}, query string, args ...interface{}) error {
+	return s.QueryContext(context.Background(), dest, query, args...)
+}
+
+// QueryContext runs query on the slave pinned to the session.
+// Route of ctx is only used when the session picks a slave.
+func (s *Session) QueryContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return s.cluster.QueryContext(WithSession(ctx, s), dest, query, args...)
+}
+
+// pick returns pinned slave while it is active, otherwise it pins the connection returned by pickFn.
+func (s *Session) pick(manager *connectionManager, pickFn func() (*connection, error)) (*connection, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn != nil && manager.isActiveSlave(s.conn) {
+		return s.conn, nil
+	}
+	s.conn = nil
+
+	conn, err := pickFn()
+	if err != nil {
+		return nil, err
+	}
+	if manager.isActiveSlave(conn) {
+		s.conn = conn
+	}
+	return conn, nil
+}
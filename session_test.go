@@ -0,0 +1,67 @@
+package hansip
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SessionTestSuite struct {
+	suite.Suite
+}
+
+func TestSession(t *testing.T) {
+	s := &SessionTestSuite{}
+	suite.Run(t, s)
+}
+
+func (s *SessionTestSuite) TestPinsSlave() {
+	a, b := newDummySlave("", ""), newDummySlave("", "")
+	cluster, _ := newDummyCluster(&Config{}, a, b)
+
+	session := cluster.Session()
+	s.Nil(session.Query(nil, "select 1;"))
+	pinned := session.conn
+	s.NotNil(pinned)
+	for i := 0; i < 20; i++ {
+		s.Nil(session.Query(nil, "select 1;"))
+		s.True(session.conn == pinned)
+	}
+
+	// through context
+	ctx := WithSession(context.Background(), session)
+	s.Nil(cluster.QueryContext(ctx, nil, "select 1;"))
+	s.True(session.conn == pinned)
+}
+
+func (s *SessionTestSuite) TestRepinsWhenSlaveLeaves() {
+	a, b := newDummySlave("", ""), newDummySlave("", "")
+	cluster, master := newDummyCluster(&Config{}, a, b)
+
+	session := cluster.Session()
+	s.Nil(session.Query(nil, "select 1;"))
+	pinned := session.conn
+	other := a
+	if pinned == a {
+		other = b
+	}
+
+	pinned.setConnected(false)
+	cluster.manager.updateActiveSlaves()
+	s.Nil(session.Query(nil, "select 1;"))
+	s.True(session.conn == other)
+
+	// coming back does not move the session
+	pinned.setConnected(true)
+	cluster.manager.updateActiveSlaves()
+	s.Nil(session.Query(nil, "select 1;"))
+	s.True(session.conn == other)
+
+	// master fallback is not pinned
+	cluster.manager.removeSlave(a)
+	cluster.manager.removeSlave(b)
+	s.Nil(session.Query(nil, "select 1;"))
+	s.True(master.queryRun)
+	s.Nil(session.conn)
+}
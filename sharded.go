@@ -0,0 +1,189 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// ErrNoShard is returned when a shard key does not map to any shard.
+var ErrNoShard = errors.New("no shard for key")
+
+// ShardFunc maps a shard key to index of one of n shards.
+// Any function works, for example one looking tenants up in a directory table.
+type ShardFunc func(key string, n int) (int, error)
+
+// HashShard spreads keys evenly by hashing them modulo number of shards.
+// Adding a shard moves most keys, use RangeShard or a lookup when shards are added over time.
+func HashShard() ShardFunc {
+	return func(key string, n int) (int, error) {
+		if n == 0 {
+			return 0, ErrNoShard
+		}
+		return int(hashKey(key) % uint64(n)), nil
+	}
+}
+
+// ShardRange assigns keys from From, inclusive, up to From of the next range to Shard.
+type ShardRange struct {
+	From  string
+	Shard int
+}
+
+// RangeShard maps keys to shards by ranges, keys are compared as strings
+// so numeric keys should be zero padded. Keys below the first range have no shard.
+func RangeShard(ranges ...ShardRange) ShardFunc {
+	sorted := append([]ShardRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].From < sorted[j].From
+	})
+	return func(key string, n int) (int, error) {
+		i := sort.Search(len(sorted), func(i int) bool {
+			return sorted[i].From > key
+		})
+		if i == 0 {
+			return 0, ErrNoShard
+		}
+		return sorted[i-1].Shard, nil
+	}
+}
+
+// ShardedCluster routes queries among clusters which each hold a part of the data.
+type ShardedCluster struct {
+	shards  []*Cluster
+	shardFn ShardFunc
+}
+
+// NewShardedCluster creates ShardedCluster routing keys among shards with shardFn,
+// shard index returned by shardFn is the position of the cluster in shards.
+func NewShardedCluster(shardFn ShardFunc, shards ...*Cluster) *ShardedCluster {
+	return &ShardedCluster{
+		shards:  shards,
+		shardFn: shardFn,
+	}
+}
+
+// Shard returns cluster holding given key.
+func (s *ShardedCluster) Shard(key string) (*Cluster, error) {
+	i, err := s.shardFn(key, len(s.shards))
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 || i >= len(s.shards) {
+		return nil, ErrNoShard
+	}
+	return s.shards[i], nil
+}
+
+// Shards returns all shards, in order of their index.
+func (s *ShardedCluster) Shards() []*Cluster {
+	return s.shards
+}
+
+// ForEach runs fn on every shard concurrently and waits for all of them.
+// ctx given to fn is cancelled once any fn fails, the first error is returned.
+func (s *ShardedCluster) ForEach(ctx context.Context, fn func(ctx context.Context, shard int, cluster *Cluster) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for i, cluster := range s.shards {
+		wg.Add(1)
+		go func(i int, cluster *Cluster) {
+			defer wg.Done()
+			if err := fn(ctx, i, cluster); err != nil {
+				once.Do(func() {
+					firstErr = fmt.Errorf("shard %d: %w", i, err)
+					cancel()
+				})
+			}
+		}(i, cluster)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// QueryAll runs query on a reader of every shard concurrently and appends all rows to dest,
+// which must be a pointer to a slice. Rows are merged in order of shards.
+func (s *ShardedCluster) QueryAll(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	slice := reflect.ValueOf(dest)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("dest must be a pointer to a slice, got %T", dest)
+	}
+
+	results := make([]reflect.Value, len(s.shards))
+	err := s.ForEach(ctx, func(ctx context.Context, shard int, cluster *Cluster) error {
+		result := reflect.New(slice.Elem().Type())
+		if err := cluster.QueryContext(ctx, result.Interface(), query, args...); err != nil {
+			return err
+		}
+		results[shard] = result.Elem()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	merged := slice.Elem()
+	for _, result := range results {
+		merged = reflect.AppendSlice(merged, result)
+	}
+	slice.Elem().Set(merged)
+	return nil
+}
+
+// ShardHealth reports health of nodes of a shard.
+type ShardHealth struct {
+	Shard int
+	Nodes []NodeHealth
+}
+
+// Health reports health of every shard, see Cluster.Health.
+func (s *ShardedCluster) Health() []ShardHealth {
+	health := make([]ShardHealth, 0, len(s.shards))
+	for i, cluster := range s.shards {
+		health = append(health, ShardHealth{
+			Shard: i,
+			Nodes: cluster.Health(),
+		})
+	}
+	return health
+}
+
+// CrossZoneReads returns the number of cross zone reads of all shards, see Cluster.CrossZoneReads.
+func (s *ShardedCluster) CrossZoneReads() uint64 {
+	var total uint64
+	for _, cluster := range s.shards {
+		total += cluster.CrossZoneReads()
+	}
+	return total
+}
+
+// Shutdown shuts all shards down concurrently, see Cluster.Shutdown.
+// Unlike ForEach, a shard failing to drain in time does not cut waiting of other shards short.
+func (s *ShardedCluster) Shutdown(ctx context.Context) error {
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, cluster := range s.shards {
+		wg.Add(1)
+		go func(i int, cluster *Cluster) {
+			defer wg.Done()
+			errs[i] = cluster.Shutdown(ctx)
+		}(i, cluster)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
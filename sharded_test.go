@@ -0,0 +1,137 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ShardedClusterTestSuite struct {
+	suite.Suite
+}
+
+func TestShardedCluster(t *testing.T) {
+	s := &ShardedClusterTestSuite{}
+	suite.Run(t, s)
+}
+
+// newShard creates a cluster whose slave returns given rows
+func (s *ShardedClusterTestSuite) newShard(rows ...string) *Cluster {
+	slave := newDummySlave("", "")
+	slave.s.(*dummySQL).queryFn = func(dest interface{}) error {
+		*dest.(*[]string) = append(*dest.(*[]string), rows...)
+		return nil
+	}
+	cluster, _ := newDummyCluster(&Config{}, slave)
+	cluster.manager.master = nil
+	return cluster
+}
+
+func (s *ShardedClusterTestSuite) TestHashShard() {
+	shardFn := HashShard()
+	counts := make([]int, 4)
+	for i := 0; i < 1000; i++ {
+		shard, err := shardFn(fmt.Sprintf("tenant-%d", i), 4)
+		s.Nil(err)
+		counts[shard]++
+	}
+	for _, count := range counts {
+		s.InDelta(250, count, 60)
+	}
+
+	// stable
+	first, _ := shardFn("tenant-1", 4)
+	second, _ := shardFn("tenant-1", 4)
+	s.Equal(first, second)
+}
+
+func (s *ShardedClusterTestSuite) TestRangeShard() {
+	shardFn := RangeShard(ShardRange{From: "m", Shard: 1}, ShardRange{From: "a", Shard: 0})
+	shard, err := shardFn("acme", 2)
+	s.Nil(err)
+	s.Equal(0, shard)
+	shard, err = shardFn("m", 2)
+	s.Nil(err)
+	s.Equal(1, shard)
+	shard, err = shardFn("zeta", 2)
+	s.Nil(err)
+	s.Equal(1, shard)
+	_, err = shardFn("0day", 2)
+	s.Equal(ErrNoShard, err)
+}
+
+func (s *ShardedClusterTestSuite) TestShard() {
+	a, b := s.newShard(), s.newShard()
+	sharded := NewShardedCluster(func(key string, n int) (int, error) {
+		switch key {
+		case "acme":
+			return 0, nil
+		case "globex":
+			return 1, nil
+		case "broken":
+			return 5, nil
+		}
+		return 0, errors.New("unknown tenant")
+	}, a, b)
+
+	cluster, err := sharded.Shard("acme")
+	s.Nil(err)
+	s.True(cluster == a)
+	cluster, err = sharded.Shard("globex")
+	s.Nil(err)
+	s.True(cluster == b)
+	_, err = sharded.Shard("broken")
+	s.Equal(ErrNoShard, err)
+	_, err = sharded.Shard("initech")
+	s.EqualError(err, "unknown tenant")
+}
+
+func (s *ShardedClusterTestSuite) TestQueryAll() {
+	sharded := NewShardedCluster(HashShard(), s.newShard("a1", "a2"), s.newShard(), s.newShard("c1"))
+
+	var rows []string
+	s.Nil(sharded.QueryAll(context.Background(), &rows, "select name from tenants;"))
+	s.Equal([]string{"a1", "a2", "c1"}, rows)
+
+	s.EqualError(sharded.QueryAll(context.Background(), rows, "select 1;"), "dest must be a pointer to a slice, got []string")
+}
+
+func (s *ShardedClusterTestSuite) TestForEachCancelsOnError() {
+	sharded := NewShardedCluster(HashShard(), s.newShard(), s.newShard())
+
+	err := sharded.ForEach(context.Background(), func(ctx context.Context, shard int, cluster *Cluster) error {
+		if shard == 0 {
+			return errors.New("boom")
+		}
+		<-ctx.Done()
+		return nil
+	})
+	s.EqualError(err, "shard 0: boom")
+}
+
+func (s *ShardedClusterTestSuite) TestForEachWrapsErrors() {
+	pgErr := &fakePGError{code: "42P01", message: "relation \"users\" does not exist"}
+	failing, _ := newDummyCluster(&Config{}, &connection{connected: 1, host: "db1:5432", role: RoleSlave, s: &failingSQL{err: pgErr}})
+	healthy, _ := newDummyCluster(&Config{})
+	sharded := NewShardedCluster(HashShard(), healthy, failing)
+
+	err := sharded.ForEach(context.Background(), func(ctx context.Context, shard int, cluster *Cluster) error {
+		return cluster.QueryContext(ctx, nil, "select * from users;")
+	})
+	var hansipErr *Error
+	s.True(errors.As(err, &hansipErr))
+	s.Equal("db1:5432", hansipErr.Node)
+	s.Equal("42P01", SQLState(err))
+}
+
+func (s *ShardedClusterTestSuite) TestHealth() {
+	sharded := NewShardedCluster(HashShard(), s.newShard(), s.newShard())
+	health := sharded.Health()
+	s.Len(health, 2)
+	s.Equal(1, health[1].Shard)
+	s.Len(health[1].Nodes, 1)
+	s.Equal(NodeUp, health[1].Nodes[0].State)
+}
@@ -1,15 +1,27 @@
 package hansip
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"reflect"
 	"runtime"
+	"strings"
 )
 
+// packagePath is the import path of this package as seen by the runtime,
+// it follows forks and vendored copies unlike a hardcoded module path.
+var packagePath = reflect.TypeOf(Cluster{}).PkgPath()
+
 // sql exposes methods needed to execute query
 type sql interface {
-	query(dest interface{}, query string, args ...interface{}) error
-	exec(query string, args ...interface{}) error
-	newTransaction() (Transaction, error)
+	query(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	exec(ctx context.Context, query string, args ...interface{}) error
+	newTransaction(ctx context.Context) (CopyTransaction, error)
+	// batch runs statements in a single round trip, it returns a result for every statement
+	batch(ctx context.Context, statements []batchStatement) ([]BatchResult, error)
+	copyFrom(ctx context.Context, r io.Reader, query string, args ...interface{}) (int, error)
+	copyTo(ctx context.Context, w io.Writer, query string, args ...interface{}) (int, error)
 }
 
 // Transaction represents an sql transaction.
@@ -21,13 +33,34 @@ type Transaction interface {
 	Rollback() error
 }
 
+// CopyTransaction is a Transaction which also runs COPY queries.
+// Transactions of Cluster implement it, type assert a Transaction to stream COPY data inside it.
+type CopyTransaction interface {
+	Transaction
+	// CopyFrom and CopyTo run COPY queries streaming from r or to w, they return the number of copied rows.
+	CopyFrom(r io.Reader, query string, args ...interface{}) (int, error)
+	CopyTo(w io.Writer, query string, args ...interface{}) (int, error)
+}
+
+// injectCallerInfo prepends sql with the first caller outside of this package.
+// Queries pass through a varying number of wrappers, such as transactions and scoped settings,
+// so frames are walked instead of skipping a fixed number of them.
 func injectCallerInfo(sql string) string {
-	pc, file, line, ok := runtime.Caller(3)
-	details := runtime.FuncForPC(pc)
-	if !ok || details == nil {
-		return sql
+	pcs := make([]uintptr, 16)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !isPackageFrame(frame) {
+			msg := fmt.Sprintf("/* %s at %s:%d */", frame.Function, frame.File, frame.Line)
+			return fmt.Sprintf("%s\n%s", msg, sql)
+		}
+		if !more {
+			return sql
+		}
 	}
+}
 
-	msg := fmt.Sprintf("/* %s at %s:%d */", details.Name(), file, line)
-	return fmt.Sprintf("%s\n%s", msg, sql)
+func isPackageFrame(frame runtime.Frame) bool {
+	return strings.HasPrefix(frame.Function, packagePath+".") && !strings.HasSuffix(frame.File, "_test.go")
 }
@@ -0,0 +1,27 @@
+package hansip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SQLTestSuite struct {
+	suite.Suite
+}
+
+func TestSQL(t *testing.T) {
+	s := &SQLTestSuite{}
+	suite.Run(t, s)
+}
+
+func (s *SQLTestSuite) TestInjectCallerInfo() {
+	sql := injectCallerInfo("select 1;")
+	s.Contains(sql, "TestInjectCallerInfo at ")
+	s.Contains(sql, "sql_test.go")
+	s.Contains(sql, "\nselect 1;")
+}
+
+func (s *SQLTestSuite) TestPackagePath() {
+	s.Equal("github.com/asasmoyo/pg-hansip", packagePath)
+}
@@ -1,6 +1,7 @@
 package hansip
 
 import (
+	"context"
 	"os"
 
 	"github.com/go-pg/pg"
@@ -22,7 +23,7 @@ func (s *TestSuite) SetupTest() {
 
 func (s *TestSuite) TearDownTest() {
 	if !s.noCreateCluster {
-		s.cluster.Shutdown()
+		s.Nil(s.cluster.Shutdown(context.Background()))
 	}
 }
 
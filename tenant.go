@@ -0,0 +1,71 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/go-pg/pg"
+)
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx which runs queries with search_path set to schema of a tenant followed by public,
+// so extensions and shared tables in public stay visible.
+// Plain queries run on a pinned connection whose search_path is reset before it goes back to the pool,
+// transactions use SET LOCAL so search_path ends with them.
+func WithTenant(ctx context.Context, schema string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, schema)
+}
+
+func tenantFromContext(ctx context.Context) (string, bool) {
+	schema, ok := ctx.Value(tenantKey{}).(string)
+	return schema, ok
+}
+
+// gopgQuerier is implemented by pg.DB, pg.Conn and pg.Tx.
+type gopgQuerier interface {
+	QueryContext(c context.Context, model, query interface{}, params ...interface{}) (pg.Result, error)
+	ExecContext(c context.Context, query interface{}, params ...interface{}) (pg.Result, error)
+	CopyFrom(r io.Reader, query interface{}, params ...interface{}) (pg.Result, error)
+	CopyTo(w io.Writer, query interface{}, params ...interface{}) (pg.Result, error)
+}
+
+// runAsTenant runs fn on db, or on a single connection with search_path of the tenant of ctx.
+func runAsTenant(ctx context.Context, db *pg.DB, fn func(q gopgQuerier) error) error {
+	schema, ok := tenantFromContext(ctx)
+	if !ok {
+		return fn(db)
+	}
+
+	conn := db.Conn()
+	defer conn.Close()
+
+	// search_path must not leak to the next user of the connection, so it is reset even when
+	// ctx is done, and the connection is closed instead of going back to the pool when the reset fails.
+	defer func() {
+		if _, err := conn.Exec("reset search_path;"); err != nil {
+			discardConn(conn)
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, "set search_path = ?, public;", pg.F(schema)); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// errConnDiscarded fails a copy on purpose, go-pg closes connections failing with errors which are not postgres errors.
+var errConnDiscarded = errors.New("connection discarded")
+
+type discardingWriter struct{}
+
+func (discardingWriter) Write(p []byte) (int, error) {
+	return 0, errConnDiscarded
+}
+
+// discardConn makes go-pg close the connection of conn instead of returning it to the pool,
+// go-pg has no API to close a single pooled connection.
+func discardConn(conn *pg.Conn) {
+	conn.CopyTo(discardingWriter{}, "copy (select 1) to stdout;")
+}
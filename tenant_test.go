@@ -0,0 +1,105 @@
+package hansip
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/go-pg/pg"
+	"github.com/stretchr/testify/suite"
+)
+
+type TenantTestSuite struct {
+	TestSuite
+}
+
+func TestTenant(t *testing.T) {
+	s := &TenantTestSuite{}
+	s.noCreateCluster = true
+	suite.Run(t, s)
+}
+
+func (s *TenantTestSuite) TestContext() {
+	_, ok := tenantFromContext(context.Background())
+	s.False(ok)
+
+	schema, ok := tenantFromContext(WithTenant(context.Background(), "tenant_a"))
+	s.True(ok)
+	s.Equal("tenant_a", schema)
+}
+
+func (s *TenantTestSuite) TestInterleavedTenants() {
+	// a small pool makes tenants share connections
+	cluster := NewCluster(&Config{Pool: PoolConfig{PoolSize: 2}})
+	defer cluster.Shutdown(context.Background())
+	s.Nil(cluster.SetMaster(s.getMasterConnectionInfo()))
+
+	tenants := []string{"hansip_tenant_a", "hansip_tenant_b"}
+	for _, tenant := range tenants {
+		s.Nil(cluster.WriterExec(fmt.Sprintf("drop schema if exists %s cascade;", tenant)))
+		s.Nil(cluster.WriterExec(fmt.Sprintf("create schema %s;", tenant)))
+		s.Nil(cluster.WriterExec(fmt.Sprintf("create table %s.owner as select '%s'::text as name;", tenant, tenant)))
+		defer cluster.WriterExec(fmt.Sprintf("drop schema %s cascade;", tenant))
+	}
+
+	var defaultPath string
+	s.Nil(cluster.WriterQuery(pg.Scan(&defaultPath), "show search_path;"))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 300)
+	for i := 0; i < 100; i++ {
+		tenant := tenants[i%2]
+		ctx := WithTenant(context.Background(), tenant)
+
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			var name string
+			if err := cluster.WriterQueryContext(ctx, pg.Scan(&name), "select name from owner;"); err != nil {
+				errs <- err
+			} else if name != tenant {
+				errs <- fmt.Errorf("query of %s saw %s", tenant, name)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			tx, err := cluster.NewTransactionContext(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer tx.Rollback()
+			var name string
+			if err := tx.Query(pg.Scan(&name), "select name from owner;"); err != nil {
+				errs <- err
+			} else if name != tenant {
+				errs <- fmt.Errorf("transaction of %s saw %s", tenant, name)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			var path string
+			if err := cluster.WriterQuery(pg.Scan(&path), "show search_path;"); err != nil {
+				errs <- err
+			} else if path != defaultPath {
+				errs <- fmt.Errorf("query without tenant saw search_path %s", path)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		s.Nil(err)
+	}
+
+	// public stays on search_path of tenants
+	var path string
+	s.Nil(cluster.WriterQueryContext(WithTenant(context.Background(), tenants[0]), pg.Scan(&path), "show search_path;"))
+	s.Equal("hansip_tenant_a, public", path)
+	tx, err := cluster.NewTransactionContext(WithTenant(context.Background(), tenants[0]))
+	s.Nil(err)
+	s.Nil(tx.Query(pg.Scan(&path), "show search_path;"))
+	s.Equal("hansip_tenant_a, public", path)
+	s.Nil(tx.Rollback())
+}
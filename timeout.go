@@ -0,0 +1,130 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// ErrStatementTimeout is matched by StatementTimeoutError with errors.Is.
+var ErrStatementTimeout = errors.New("statement timeout")
+
+// StatementTimeoutError is returned when a query runs longer than its statement timeout.
+type StatementTimeoutError struct {
+	// Node is the host the query ran on.
+	Node string
+	// Timeout is the timeout which was exceeded.
+	Timeout time.Duration
+	Err     error
+}
+
+// Error leaves Node out, it is already named by Error wrapping it.
+func (e *StatementTimeoutError) Error() string {
+	if e.Timeout > 0 {
+		return fmt.Sprintf("statement timeout after %s: %v", e.Timeout, e.Err)
+	}
+	return fmt.Sprintf("statement timeout: %v", e.Err)
+}
+
+// Is makes errors.Is(err, ErrStatementTimeout) true.
+func (e *StatementTimeoutError) Is(target error) bool {
+	return target == ErrStatementTimeout
+}
+
+// Unwrap returns the error of the driver.
+func (e *StatementTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+type statementTimeoutKey struct{}
+
+// WithStatementTimeout returns a copy of ctx which bounds runtime of each query to timeout,
+// overriding Config.DefaultStatementTimeout. Zero disables the default timeout.
+func WithStatementTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, statementTimeoutKey{}, timeout)
+}
+
+func statementTimeoutFromContext(ctx context.Context) (time.Duration, bool) {
+	timeout, ok := ctx.Value(statementTimeoutKey{}).(time.Duration)
+	return timeout, ok
+}
+
+// runWithTimeout runs fn with ctx bounded by timeout, go-pg cancels the query on the server once ctx is done.
+// Timeouts are reported as StatementTimeoutError of node.
+func runWithTimeout(ctx context.Context, node string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := fn(timeoutCtx)
+	// a deadline or cancel of the caller is not a statement timeout
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	if timeoutCtx.Err() == context.DeadlineExceeded {
+		return &StatementTimeoutError{Node: node, Timeout: timeout, Err: err}
+	}
+	return asStatementTimeout(err, node, timeout)
+}
+
+// asStatementTimeout converts query_canceled errors of statements which ran with timeout applied,
+// such as statement_timeout set for a transaction. Errors of statements without timeout are returned as they are.
+// postgres tells why a statement was cancelled only in the localized message, so a statement cancelled by
+// another session, for example with pg_cancel_backend, while a timeout applies is reported as a timeout too.
+func asStatementTimeout(err error, node string, timeout time.Duration) error {
+	if timeout <= 0 {
+		return err
+	}
+	if pgErr, ok := err.(pg.Error); ok && pgErr.Field('C') == "57014" {
+		return &StatementTimeoutError{Node: node, Timeout: timeout, Err: err}
+	}
+	return err
+}
+
+// nodeTransaction wraps errors of a transaction with its node, statement timeouts become StatementTimeoutError.
+type nodeTransaction struct {
+	CopyTransaction
+	conn    *connection
+	timeout time.Duration
+	endOnce sync.Once
+}
+
+func (tx *nodeTransaction) Query(dest interface{}, query string, args ...interface{}) error {
+	err := asStatementTimeout(tx.CopyTransaction.Query(dest, query, args...), tx.conn.host, tx.timeout)
+	return tx.conn.wrapError("query", err)
+}
+
+func (tx *nodeTransaction) Exec(query string, args ...interface{}) error {
+	err := asStatementTimeout(tx.CopyTransaction.Exec(query, args...), tx.conn.host, tx.timeout)
+	return tx.conn.wrapError("exec", err)
+}
+
+func (tx *nodeTransaction) CopyFrom(r io.Reader, query string, args ...interface{}) (int, error) {
+	rows, err := tx.CopyTransaction.CopyFrom(r, query, args...)
+	err = asStatementTimeout(err, tx.conn.host, tx.timeout)
+	return rows, tx.conn.wrapError("copy from", err)
+}
+
+func (tx *nodeTransaction) CopyTo(w io.Writer, query string, args ...interface{}) (int, error) {
+	rows, err := tx.CopyTransaction.CopyTo(w, query, args...)
+	err = asStatementTimeout(err, tx.conn.host, tx.timeout)
+	return rows, tx.conn.wrapError("copy to", err)
+}
+
+func (tx *nodeTransaction) Commit() error {
+	defer tx.endOnce.Do(tx.conn.endWork)
+	return tx.conn.wrapError("commit", tx.CopyTransaction.Commit())
+}
+
+func (tx *nodeTransaction) Rollback() error {
+	defer tx.endOnce.Do(tx.conn.endWork)
+	return tx.conn.wrapError("rollback", tx.CopyTransaction.Rollback())
+}
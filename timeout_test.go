@@ -0,0 +1,135 @@
+package hansip
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type StatementTimeoutTestSuite struct {
+	TestSuite
+}
+
+func TestStatementTimeout(t *testing.T) {
+	s := &StatementTimeoutTestSuite{}
+	s.noCreateCluster = true
+	suite.Run(t, s)
+}
+
+// sleepSQL runs every query for duration unless ctx is done first
+type sleepSQL struct {
+	dummySQL
+	duration time.Duration
+	txCtx    context.Context
+}
+
+func (d *sleepSQL) query(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	select {
+	case <-time.After(d.duration):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *sleepSQL) newTransaction(ctx context.Context) (CopyTransaction, error) {
+	d.txCtx = ctx
+	return &dummyTransaction{}, nil
+}
+
+func (s *StatementTimeoutTestSuite) TestDefaultTimeout() {
+	conn := &connection{
+		host:             "db1:5432",
+		role:             RoleSlave,
+		statementTimeout: 20 * time.Millisecond,
+		s:                &sleepSQL{duration: time.Second},
+	}
+
+	err := conn.query(context.Background(), nil, "select pg_sleep(1);")
+	s.True(errors.Is(err, ErrStatementTimeout))
+	var timeoutErr *StatementTimeoutError
+	s.True(errors.As(err, &timeoutErr))
+	s.Equal("db1:5432", timeoutErr.Node)
+	s.Equal(20*time.Millisecond, timeoutErr.Timeout)
+	s.EqualError(err, "hansip: query on slave db1:5432: statement timeout after 20ms: context deadline exceeded")
+}
+
+func (s *StatementTimeoutTestSuite) TestOverride() {
+	conn := &connection{
+		host:             "db1:5432",
+		statementTimeout: 20 * time.Millisecond,
+		s:                &sleepSQL{duration: 50 * time.Millisecond},
+	}
+
+	s.Nil(conn.query(WithStatementTimeout(context.Background(), 0), nil, "select pg_sleep(0.05);"))
+	s.Nil(conn.query(WithStatementTimeout(context.Background(), time.Second), nil, "select pg_sleep(0.05);"))
+
+	var timeoutErr *StatementTimeoutError
+	s.True(errors.As(conn.query(WithStatementTimeout(context.Background(), 10*time.Millisecond), nil, "select pg_sleep(0.05);"), &timeoutErr))
+	s.Equal(10*time.Millisecond, timeoutErr.Timeout)
+}
+
+func (s *StatementTimeoutTestSuite) TestCallerDeadline() {
+	conn := &connection{
+		host:             "db1:5432",
+		statementTimeout: time.Second,
+		s:                &sleepSQL{duration: time.Second},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := conn.query(ctx, nil, "select pg_sleep(1);")
+	s.True(errors.Is(err, context.DeadlineExceeded))
+	s.False(errors.Is(err, ErrStatementTimeout))
+}
+
+func (s *StatementTimeoutTestSuite) TestQueryCanceled() {
+	canceled := &fakePGError{code: "57014", message: "canceling statement due to user request"}
+	s.Equal(canceled, asStatementTimeout(canceled, "db1:5432", 0))
+	s.True(errors.Is(asStatementTimeout(canceled, "db1:5432", time.Second), ErrStatementTimeout))
+
+	// a cancel of the caller is not a timeout even when the server reports query_canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := runWithTimeout(ctx, "db1:5432", time.Second, func(ctx context.Context) error {
+		return canceled
+	})
+	s.Equal(canceled, err)
+}
+
+func (s *StatementTimeoutTestSuite) TestTransaction() {
+	sql := &sleepSQL{}
+	conn := &connection{
+		host:             "db1:5432",
+		statementTimeout: 5 * time.Second,
+		s:                sql,
+	}
+
+	_, err := conn.newTransaction(context.Background())
+	s.Nil(err)
+	timeout, ok := statementTimeoutFromContext(sql.txCtx)
+	s.True(ok)
+	s.Equal(5*time.Second, timeout)
+}
+
+func (s *StatementTimeoutTestSuite) TestServerSide() {
+	cluster := NewCluster(&Config{DefaultStatementTimeout: 100 * time.Millisecond})
+	defer cluster.Shutdown(context.Background())
+	master := s.getMasterConnectionInfo()
+	s.Nil(cluster.SetMaster(master))
+
+	var timeoutErr *StatementTimeoutError
+	s.True(errors.As(cluster.WriterExec("select pg_sleep(1);"), &timeoutErr))
+	s.Equal(master.Addr, timeoutErr.Node)
+
+	tx, err := cluster.NewTransaction()
+	s.Nil(err)
+	if tx == nil {
+		return
+	}
+	defer tx.Rollback()
+	s.True(errors.Is(tx.Exec("select pg_sleep(1);"), ErrStatementTimeout))
+}
@@ -0,0 +1,264 @@
+package hansip
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+const defaultTLSReloadInterval = 1 * time.Minute
+
+// TLSConfig contains TLS settings applied to every node.
+// Servers are verified like sslmode=verify-full: the certificate must be signed by a trusted CA
+// and match the server name, which is the host of the node unless ServerName node option is given.
+type TLSConfig struct {
+	// CAFile is a PEM file of certificate authorities trusted to sign server certificates.
+	// System roots are used when it is empty.
+	CAFile string
+	// CertFile and KeyFile are PEM files of the client certificate, they are optional.
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify encrypts connections without verifying servers, like sslmode=require.
+	InsecureSkipVerify bool
+	// ReloadInterval is how often files are checked for changes during handshakes, defaults to 1 minute.
+	// Rotated files are picked up by new connections, open connections are kept.
+	ReloadInterval time.Duration
+
+	once  sync.Once
+	files *tlsFiles
+}
+
+// ServerName overrides name used to verify certificate of a node,
+// for example when connecting through an ip address or a proxy.
+func ServerName(name string) NodeOption {
+	return func(o *nodeOptions) {
+		o.serverName = name
+	}
+}
+
+// tlsError is returned when TLS files can not be loaded or the server certificate is rejected.
+type tlsError struct {
+	err error
+}
+
+func (e *tlsError) Error() string {
+	return fmt.Sprintf("tls: %v", e.err)
+}
+
+// isTLSError tells whether err comes from a failed TLS handshake.
+func isTLSError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var tlsErr *tlsError
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &tlsErr) || errors.As(err, &recordErr) {
+		return true
+	}
+	// alerts sent by the server, for example when it rejects the client certificate
+	msg := err.Error()
+	return strings.Contains(msg, "remote error: tls:") || msg == "pg: SSL is not enabled on the server"
+}
+
+// nodeTLSOptions returns a copy of options using conf to encrypt connections.
+// Options are returned as they are when conf is nil, so sslmode of a url keeps working.
+func nodeTLSOptions(options *pg.Options, conf *TLSConfig, serverName string) (*pg.Options, error) {
+	if conf == nil {
+		return options, nil
+	}
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(options.Addr)
+		if err != nil {
+			return nil, err
+		}
+		serverName = host
+	}
+
+	conf.once.Do(func() {
+		conf.files = newTLSFiles(conf)
+	})
+	if err := conf.files.load(); err != nil {
+		return nil, err
+	}
+
+	opts := *options
+	opts.TLSConfig = conf.files.clientConfig(serverName)
+	return &opts, nil
+}
+
+// tlsFiles holds certificates loaded from files of TLSConfig,
+// files are read again at most every ReloadInterval and only replace current ones when they parse.
+type tlsFiles struct {
+	conf     *TLSConfig
+	interval time.Duration
+
+	mutex     sync.Mutex
+	checkedAt time.Time
+	content   []byte
+	roots     *x509.CertPool
+	cert      *tls.Certificate
+}
+
+func newTLSFiles(conf *TLSConfig) *tlsFiles {
+	interval := conf.ReloadInterval
+	if interval == 0 {
+		interval = defaultTLSReloadInterval
+	}
+	return &tlsFiles{
+		conf:     conf,
+		interval: interval,
+	}
+}
+
+// load reads files when they were not checked within interval.
+// Files which fail to load after a successful load keep previous certificates in use,
+// for example while they are half written during rotation.
+func (f *tlsFiles) load() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.checkedAt.IsZero() && time.Since(f.checkedAt) < f.interval {
+		return nil
+	}
+
+	if err := f.read(); err != nil && f.content == nil {
+		return err
+	}
+	f.checkedAt = time.Now()
+	return nil
+}
+
+func (f *tlsFiles) read() error {
+	var content [][]byte
+	for _, path := range []string{f.conf.CAFile, f.conf.CertFile, f.conf.KeyFile} {
+		if path == "" {
+			content = append(content, nil)
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return &tlsError{err: err}
+		}
+		content = append(content, data)
+	}
+	joined := bytes.Join(content, []byte{0})
+	if f.content != nil && bytes.Equal(joined, f.content) {
+		return nil
+	}
+
+	var roots *x509.CertPool
+	if ca := content[0]; ca != nil {
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(ca) {
+			return &tlsError{err: fmt.Errorf("no certificate found in %s", f.conf.CAFile)}
+		}
+	}
+	var cert *tls.Certificate
+	if content[1] != nil || content[2] != nil {
+		pair, err := tls.X509KeyPair(content[1], content[2])
+		if err != nil {
+			return &tlsError{err: err}
+		}
+		cert = &pair
+	}
+
+	f.content, f.roots, f.cert = joined, roots, cert
+	return nil
+}
+
+func (f *tlsFiles) current() (*x509.CertPool, *tls.Certificate) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.roots, f.cert
+}
+
+// clientConfig creates tls.Config which takes certificates from f on every handshake.
+// Built in verification is replaced by VerifyConnection so a rotated CA applies without a new tls.Config.
+func (f *tlsFiles) clientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if err := f.load(); err != nil {
+				return nil, err
+			}
+			if _, cert := f.current(); cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if f.conf.InsecureSkipVerify {
+				return nil
+			}
+			if err := f.load(); err != nil {
+				return err
+			}
+			roots, _ := f.current()
+			return verifyServer(state, roots, serverName)
+		},
+	}
+}
+
+func verifyServer(state tls.ConnectionState, roots *x509.CertPool, serverName string) error {
+	if len(state.PeerCertificates) == 0 {
+		return &tlsError{err: errors.New("server sent no certificate")}
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return &tlsError{err: err}
+	}
+	return nil
+}
+
+// FileTLSConfig is TLSConfig written in a config file.
+type FileTLSConfig struct {
+	CAFile             string   `json:"ca_file" yaml:"ca_file" toml:"ca_file"`
+	CertFile           string   `json:"cert_file" yaml:"cert_file" toml:"cert_file"`
+	KeyFile            string   `json:"key_file" yaml:"key_file" toml:"key_file"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify" yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+	ReloadInterval     Duration `json:"reload_interval" yaml:"reload_interval" toml:"reload_interval"`
+}
+
+// TLSConfig converts f to TLSConfig, nil stays nil.
+func (f *FileTLSConfig) TLSConfig() *TLSConfig {
+	if f == nil {
+		return nil
+	}
+	return &TLSConfig{
+		CAFile:             f.CAFile,
+		CertFile:           f.CertFile,
+		KeyFile:            f.KeyFile,
+		InsecureSkipVerify: f.InsecureSkipVerify,
+		ReloadInterval:     time.Duration(f.ReloadInterval),
+	}
+}
+
+func (f *FileTLSConfig) validate() error {
+	if f == nil {
+		return nil
+	}
+	if (f.CertFile == "") != (f.KeyFile == "") {
+		return errors.New("cert_file and key_file must be given together")
+	}
+	if f.ReloadInterval < 0 {
+		return fmt.Errorf("reload_interval must not be negative, got %s", time.Duration(f.ReloadInterval))
+	}
+	return nil
+}
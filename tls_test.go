@@ -0,0 +1,230 @@
+package hansip
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/stretchr/testify/suite"
+)
+
+type TLSTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func TestTLS(t *testing.T) {
+	s := &TLSTestSuite{}
+	suite.Run(t, s)
+}
+
+func (s *TLSTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "hansip-tls")
+	s.Nil(err)
+	s.dir = dir
+}
+
+func (s *TLSTestSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(s *TLSTestSuite) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Nil(err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hansip test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	s.Nil(err)
+	cert, err := x509.ParseCertificate(der)
+	s.Nil(err)
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue creates a certificate for given host signed by ca, returned as PEM encoded cert and key.
+func (ca *testCA) issue(s *TLSTestSuite, host string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Nil(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	s.Nil(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	s.Nil(err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (s *TLSTestSuite) write(name string, data []byte) string {
+	path := filepath.Join(s.dir, name)
+	s.Nil(ioutil.WriteFile(path, data, 0600))
+	return path
+}
+
+// handshake runs a TLS handshake between a client using conf and a server using serverCert.
+// A loopback listener buffers alerts of a rejected handshake which would block both ends of a net.Pipe.
+func (s *TLSTestSuite) handshake(conf *tls.Config, serverCert tls.Certificate) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().Nil(err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer server.Close()
+		server.SetDeadline(time.Now().Add(5 * time.Second))
+		tls.Server(server, &tls.Config{Certificates: []tls.Certificate{serverCert}}).Handshake()
+	}()
+	defer func() { <-done }()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	s.Require().Nil(err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return tls.Client(client, conf).Handshake()
+}
+
+func (s *TLSTestSuite) TestVerifiesServer() {
+	ca := newTestCA(s)
+	certPEM, keyPEM := ca.issue(s, "db.internal")
+	serverCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	s.Nil(err)
+
+	conf := &TLSConfig{CAFile: s.write("ca.pem", ca.pem)}
+	opts, err := nodeTLSOptions(&pg.Options{Addr: "db.internal:5432"}, conf, "")
+	s.Nil(err)
+	s.Equal("db.internal", opts.TLSConfig.ServerName)
+	s.Nil(s.handshake(opts.TLSConfig, serverCert))
+
+	// connecting through an ip address needs ServerName
+	opts, err = nodeTLSOptions(&pg.Options{Addr: "10.0.0.1:5432"}, conf, "")
+	s.Nil(err)
+	err = s.handshake(opts.TLSConfig, serverCert)
+	s.NotNil(err)
+	s.True(isTLSError(err))
+
+	opts, err = nodeTLSOptions(&pg.Options{Addr: "10.0.0.1:5432"}, conf, "db.internal")
+	s.Nil(err)
+	s.Nil(s.handshake(opts.TLSConfig, serverCert))
+}
+
+func (s *TLSTestSuite) TestReloadsRotatedFiles() {
+	oldCA, newCA := newTestCA(s), newTestCA(s)
+	certPEM, keyPEM := newCA.issue(s, "db.internal")
+	serverCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	s.Nil(err)
+
+	caFile := s.write("ca.pem", oldCA.pem)
+	conf := &TLSConfig{
+		CAFile:         caFile,
+		ReloadInterval: 10 * time.Millisecond,
+	}
+	opts, err := nodeTLSOptions(&pg.Options{Addr: "db.internal:5432"}, conf, "")
+	s.Nil(err)
+	s.NotNil(s.handshake(opts.TLSConfig, serverCert))
+
+	// a broken file keeps previous certificates
+	s.write("ca.pem", []byte("garbage"))
+	time.Sleep(20 * time.Millisecond)
+	s.NotNil(s.handshake(opts.TLSConfig, serverCert))
+	roots, _ := conf.files.current()
+	s.NotNil(roots)
+
+	s.write("ca.pem", newCA.pem)
+	time.Sleep(20 * time.Millisecond)
+	s.Nil(s.handshake(opts.TLSConfig, serverCert))
+}
+
+func (s *TLSTestSuite) TestInvalidFiles() {
+	_, err := nodeTLSOptions(&pg.Options{Addr: "db:5432"}, &TLSConfig{CAFile: s.write("ca.pem", []byte("garbage"))}, "")
+	s.True(isTLSError(err))
+
+	_, err = nodeTLSOptions(&pg.Options{Addr: "db:5432"}, &TLSConfig{CAFile: filepath.Join(s.dir, "missing.pem")}, "")
+	s.True(isTLSError(err))
+
+	cc := &ClusterConfig{
+		Master: NodeConfig{URL: "postgres://app@db:5432/app"},
+		TLS:    &FileTLSConfig{CertFile: "client.pem"},
+	}
+	s.EqualError(cc.Validate(), "tls: cert_file and key_file must be given together")
+}
+
+func (s *TLSTestSuite) TestHealthReportsTLSFailure() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Nil(err)
+	defer ln.Close()
+
+	// the server accepts SSLRequest and presents a certificate from an unknown CA
+	certPEM, keyPEM := newTestCA(s).issue(s, "127.0.0.1")
+	serverCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	s.Nil(err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := io.ReadFull(conn, make([]byte, 8)); err != nil {
+					return
+				}
+				conn.Write([]byte("S"))
+				tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{serverCert}}).Handshake()
+			}()
+		}
+	}()
+
+	cluster := NewCluster(&Config{
+		LazyConnect: true,
+		TLS:         &TLSConfig{CAFile: s.write("ca.pem", newTestCA(s).pem)},
+	})
+	defer cluster.Shutdown(context.Background())
+
+	s.Nil(cluster.AddSlave(&pg.Options{Addr: ln.Addr().String()}, ServerName("127.0.0.1")))
+	health := cluster.Health()
+	s.Len(health, 1)
+	s.False(health[0].Master)
+	s.Equal(NodeTLSFailed, health[0].State)
+}
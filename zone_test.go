@@ -0,0 +1,86 @@
+package hansip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ZoneTestSuite struct {
+	suite.Suite
+}
+
+func TestZone(t *testing.T) {
+	s := &ZoneTestSuite{}
+	suite.Run(t, s)
+}
+
+func (s *ZoneTestSuite) newManager(localZone string, threshold int, slaves ...*connection) *connectionManager {
+	manager := &connectionManager{}
+	manager.setLocality(localZone, threshold)
+	for _, slave := range slaves {
+		manager.addSlave(slave)
+	}
+	return manager
+}
+
+func (s *ZoneTestSuite) TestPrefersLocalZone() {
+	local, remote := newDummySlave("", "a"), newDummySlave("", "b")
+	manager := s.newManager("a", 0, local, remote)
+
+	for i := 0; i < 20; i++ {
+		s.True(manager.pickReader(nil) == local)
+	}
+	s.Equal(uint64(0), manager.getCrossZoneReads())
+
+	// spills over when local slaves are down
+	local.setConnected(false)
+	manager.updateActiveSlaves()
+	s.True(manager.pickReader(nil) == remote)
+	s.Equal(uint64(1), manager.getCrossZoneReads())
+}
+
+func (s *ZoneTestSuite) TestSpillsOverWhenSaturated() {
+	local, remote := newDummySlave("", "a"), newDummySlave("", "b")
+	manager := s.newManager("a", 2, local, remote)
+
+	local.inflight = 1
+	s.True(manager.pickReader(nil) == local)
+
+	local.inflight = 2
+	s.True(manager.pickReader(nil) == remote)
+	s.Equal(uint64(1), manager.getCrossZoneReads())
+
+	// every slave saturated, reads are spread over all of them again
+	remote.inflight = 2
+	picked := map[*connection]bool{}
+	for i := 0; i < 50; i++ {
+		picked[manager.pickReader(nil)] = true
+	}
+	s.True(picked[local])
+	s.True(picked[remote])
+}
+
+func (s *ZoneTestSuite) TestWithoutLocalZone() {
+	a, b := newDummySlave("", "a"), newDummySlave("", "b")
+	manager := s.newManager("", 0, a, b)
+
+	picked := map[*connection]bool{}
+	for i := 0; i < 50; i++ {
+		picked[manager.pickReader(nil)] = true
+	}
+	s.Len(picked, 2)
+	s.Equal(uint64(0), manager.getCrossZoneReads())
+}
+
+func (s *ZoneTestSuite) TestClusterCountsCrossZoneReads() {
+	remote := newDummySlave("", "b")
+	cluster := &Cluster{
+		manager: s.newManager("a", 0, remote),
+		conf:    &Config{LocalZone: "a"},
+	}
+	s.Nil(cluster.Query(nil, "select 1;"))
+	s.Nil(cluster.QueryOn("analytics", nil, "select 1;"))
+	s.Equal(uint64(2), cluster.CrossZoneReads())
+	s.Equal(0, remote.getInflight())
+}